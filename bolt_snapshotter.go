@@ -1,22 +1,46 @@
 package butteredscones
 
 import (
-	"github.com/boltdb/bolt"
+	"encoding/json"
 	"strconv"
+
+	"github.com/boltdb/bolt"
 )
 
 const (
-	boltSnapshotterBucket = "high_water_marks"
+	boltSnapshotterBucket = "file_high_water_marks"
+
+	// Before files were identified by FileID, high water marks were keyed by
+	// path in this bucket. It is still consulted so upgrading doesn't re-send
+	// every file from the beginning.
+	boltSnapshotterLegacyBucket = "high_water_marks"
 )
 
 type BoltSnapshotter struct {
 	DB *bolt.DB
 }
 
-func (s *BoltSnapshotter) HighWaterMark(filePath string) (*HighWaterMark, error) {
-	highWaterMark := &HighWaterMark{FilePath: filePath}
+type boltHighWaterMark struct {
+	FilePath string `json:"path"`
+	Position int64  `json:"position"`
+}
+
+func (s *BoltSnapshotter) HighWaterMark(fileID FileID, filePath string) (*HighWaterMark, error) {
+	highWaterMark := &HighWaterMark{FileID: fileID, FilePath: filePath}
 	err := s.DB.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(boltSnapshotterBucket))
+		if bucket := tx.Bucket([]byte(boltSnapshotterBucket)); bucket != nil {
+			if markBytes := bucket.Get([]byte(fileID.String())); markBytes != nil {
+				var mark boltHighWaterMark
+				if err := json.Unmarshal(markBytes, &mark); err != nil {
+					return err
+				}
+
+				highWaterMark.Position = mark.Position
+				return nil
+			}
+		}
+
+		bucket := tx.Bucket([]byte(boltSnapshotterLegacyBucket))
 		if bucket == nil {
 			return nil
 		}
@@ -47,12 +71,62 @@ func (s *BoltSnapshotter) SetHighWaterMarks(marks []*HighWaterMark) error {
 		if err != nil {
 			return err
 		}
+		legacyBucket := tx.Bucket([]byte(boltSnapshotterLegacyBucket))
 
 		for _, mark := range marks {
-			err = bucket.Put([]byte(mark.FilePath), []byte(strconv.FormatInt(mark.Position, 10)))
+			markBytes, err := json.Marshal(&boltHighWaterMark{FilePath: mark.FilePath, Position: mark.Position})
 			if err != nil {
 				return err
 			}
+
+			err = bucket.Put([]byte(mark.FileID.String()), markBytes)
+			if err != nil {
+				return err
+			}
+
+			// Once a file has a high water mark of its own, the legacy entry for its
+			// path must not be applied to whatever file is at that path next.
+			if legacyBucket != nil {
+				if err = legacyBucket.Delete([]byte(mark.FilePath)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+func (s *BoltSnapshotter) PruneHighWaterMarks(keep func(fileID FileID) bool) error {
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltSnapshotterBucket))
+		if bucket == nil {
+			return nil
+		}
+
+		// Keys can't be deleted while they're being iterated over
+		pruned := make([][]byte, 0)
+		err := bucket.ForEach(func(key []byte, _ []byte) error {
+			fileID, err := parseFileID(string(key))
+			if err != nil {
+				return err
+			}
+
+			if !keep(fileID) {
+				pruned = append(pruned, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range pruned {
+			if err = bucket.Delete(key); err != nil {
+				return err
+			}
 		}
 
 		return nil
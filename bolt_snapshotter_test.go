@@ -23,8 +23,10 @@ func TestBoltSnapshotter(t *testing.T) {
 	var snapshotter Snapshotter
 	snapshotter = &BoltSnapshotter{DB: db}
 
+	fileID := FileID{Device: 2049, Inode: 131}
+
 	// Default is 0
-	highWaterMark, err := snapshotter.HighWaterMark("/tmp/foo")
+	highWaterMark, err := snapshotter.HighWaterMark(fileID, "/tmp/foo")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,14 +39,14 @@ func TestBoltSnapshotter(t *testing.T) {
 
 	// Set
 	err = snapshotter.SetHighWaterMarks([]*HighWaterMark{
-		&HighWaterMark{FilePath: "/tmp/foo", Position: 10245},
+		&HighWaterMark{FileID: fileID, FilePath: "/tmp/foo", Position: 10245},
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Retrieve the value we just stored
-	highWaterMark, err = snapshotter.HighWaterMark("/tmp/foo")
+	highWaterMark, err = snapshotter.HighWaterMark(fileID, "/tmp/foo")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,3 +57,89 @@ func TestBoltSnapshotter(t *testing.T) {
 		t.Fatalf("Expected Position=%d, but got %d", 10245, highWaterMark.Position)
 	}
 }
+
+func TestBoltSnapshotterRenamedFile(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	db, err := bolt.Open(tmpFile.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotter := &BoltSnapshotter{DB: db}
+
+	rotatedID := FileID{Device: 2049, Inode: 131}
+	err = snapshotter.SetHighWaterMarks([]*HighWaterMark{
+		&HighWaterMark{FileID: rotatedID, FilePath: "/tmp/foo", Position: 10245},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same file, under a new name, keeps its position
+	highWaterMark, err := snapshotter.HighWaterMark(rotatedID, "/tmp/foo.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highWaterMark.Position != 10245 {
+		t.Fatalf("Expected Position=%d, but got %d", 10245, highWaterMark.Position)
+	}
+
+	// A new file at the old path starts from the beginning
+	highWaterMark, err = snapshotter.HighWaterMark(FileID{Device: 2049, Inode: 132}, "/tmp/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highWaterMark.Position != 0 {
+		t.Fatalf("Expected Position=%d, but got %d", 0, highWaterMark.Position)
+	}
+}
+
+func TestBoltSnapshotterPrune(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	db, err := bolt.Open(tmpFile.Name(), 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotter := &BoltSnapshotter{DB: db}
+
+	deletedID := FileID{Device: 2049, Inode: 131}
+	keptID := FileID{Device: 2049, Inode: 132}
+	err = snapshotter.SetHighWaterMarks([]*HighWaterMark{
+		&HighWaterMark{FileID: deletedID, FilePath: "/tmp/foo.1", Position: 10245},
+		&HighWaterMark{FileID: keptID, FilePath: "/tmp/foo", Position: 512},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = snapshotter.PruneHighWaterMarks(func(fileID FileID) bool { return fileID == keptID })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new file that reuses a pruned file's ID starts from the beginning
+	highWaterMark, err := snapshotter.HighWaterMark(deletedID, "/tmp/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highWaterMark.Position != 0 {
+		t.Fatalf("Expected Position=%d, but got %d", 0, highWaterMark.Position)
+	}
+
+	highWaterMark, err = snapshotter.HighWaterMark(keptID, "/tmp/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highWaterMark.Position != 512 {
+		t.Fatalf("Expected Position=%d, but got %d", 512, highWaterMark.Position)
+	}
+}
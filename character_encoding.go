@@ -0,0 +1,107 @@
+package butteredscones
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// characterEncoding converts records from a file's character encoding to
+// UTF-8. Sequences that aren't valid in the encoding are replaced with
+// U+FFFD. A nil *characterEncoding leaves records as they are.
+type characterEncoding struct {
+	decoder *encoding.Decoder
+	encoder *encoding.Encoder
+
+	// The size of each code unit. Delimiters only match on a code unit
+	// boundary, so e.g. "\n" in UTF-16 isn't found in the middle of a
+	// character.
+	unitSize int
+
+	// The byte order mark that may start files in this encoding
+	bom []byte
+}
+
+var characterEncodings = map[string]func() (encoding.Encoding, int, []byte){
+	"utf-8": func() (encoding.Encoding, int, []byte) { return unicode.UTF8, 1, []byte("\xef\xbb\xbf") },
+	"utf-16le": func() (encoding.Encoding, int, []byte) {
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), 2, []byte("\xff\xfe")
+	},
+	"utf-16be": func() (encoding.Encoding, int, []byte) {
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), 2, []byte("\xfe\xff")
+	},
+	"iso-8859-1":   func() (encoding.Encoding, int, []byte) { return charmap.ISO8859_1, 1, nil },
+	"latin1":       func() (encoding.Encoding, int, []byte) { return charmap.ISO8859_1, 1, nil },
+	"windows-1252": func() (encoding.Encoding, int, []byte) { return charmap.Windows1252, 1, nil },
+	"shift_jis":    func() (encoding.Encoding, int, []byte) { return japanese.ShiftJIS, 1, nil },
+	"euc-jp":       func() (encoding.Encoding, int, []byte) { return japanese.EUCJP, 1, nil },
+	"gbk":          func() (encoding.Encoding, int, []byte) { return simplifiedchinese.GBK, 1, nil },
+}
+
+// newCharacterEncoding returns the named encoding, or nil if no encoding is
+// named.
+func newCharacterEncoding(name string) (*characterEncoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	lookup, ok := characterEncodings[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+
+	enc, unitSize, bom := lookup()
+	return &characterEncoding{
+		decoder:  enc.NewDecoder(),
+		encoder:  enc.NewEncoder(),
+		unitSize: unitSize,
+		bom:      bom,
+	}, nil
+}
+
+// decode converts a record to UTF-8.
+func (e *characterEncoding) decode(record []byte) []byte {
+	if e == nil {
+		return record
+	}
+
+	decoded, err := e.decoder.Bytes(record)
+	if err != nil {
+		// Decoders replace invalid sequences rather than failing, so this
+		// shouldn't happen. Don't send the raw bytes regardless.
+		return []byte("\ufffd")
+	}
+	return decoded
+}
+
+// encode converts UTF-8 (e.g. a configured delimiter) to the encoding.
+func (e *characterEncoding) encode(text []byte) ([]byte, error) {
+	if e == nil {
+		return text, nil
+	}
+
+	return e.encoder.Bytes(text)
+}
+
+// trimBOM removes the byte order mark from the first record in a file.
+func (e *characterEncoding) trimBOM(record []byte) []byte {
+	if e == nil || e.bom == nil {
+		return record
+	}
+
+	return bytes.TrimPrefix(record, e.bom)
+}
+
+func (e *characterEncoding) alignment() int {
+	if e == nil {
+		return 1
+	}
+
+	return e.unitSize
+}
@@ -2,9 +2,13 @@ package client
 
 import (
 	"fmt"
+	"sync"
 )
 
-type Data map[string]string
+// Data is a single event. Values are usually strings, but may be any value
+// that can be encoded as JSON, including numbers and nested maps or slices,
+// if the remote system supports it.
+type Data map[string]interface{}
 
 type Client interface {
 	// A human-readable unique name for the client, for use in statistics. A
@@ -12,34 +16,67 @@ type Client interface {
 	// instance.
 	Name() string
 
-	// Send forwards a payload of `Data` instances to a remote system
-	Send(lines []Data) error
+	// Send forwards a payload of `Data` instances to a remote system. It
+	// returns the number of lines, from the beginning of lines, that the remote
+	// system acknowledged. If that is fewer than all of them, err explains why.
+	Send(lines []Data) (int, error)
 }
 
 // TestClient is an in-memory client that allows inspecting the data that was
 // 'sent' thorugh it. It is useful in test cases.
 type TestClient struct {
+	// Use Sent to read DataSent while the client may be sending.
 	DataSent []Data
+	lock     sync.Mutex
 
 	// Set Error to return an error to clients when they call Send. It is useful
 	// for testing how they react to errors.
 	Error error
+
+	// Set AckLimit to acknowledge at most that many lines per call to Send. It
+	// is useful for testing how clients react to partial acknowledgements.
+	AckLimit int
 }
 
 func (c *TestClient) Name() string {
 	return fmt.Sprintf("TestClient[%p]", c)
 }
 
-func (c *TestClient) Send(lines []Data) error {
+// Sent returns a copy of the data sent so far.
+func (c *TestClient) Sent() []Data {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.DataSent == nil {
+		return nil
+	}
+	return append([]Data(nil), c.DataSent...)
+}
+
+// SetError changes Error while the client may be sending.
+func (c *TestClient) SetError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Error = err
+}
+
+func (c *TestClient) Send(lines []Data) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.DataSent == nil {
 		c.DataSent = make([]Data, 0)
 	}
 
 	if c.Error != nil {
-		return c.Error
+		return 0, c.Error
+	} else if c.AckLimit > 0 && len(lines) > c.AckLimit {
+		c.DataSent = append(c.DataSent, lines[:c.AckLimit]...)
+		return c.AckLimit, fmt.Errorf("only %d of %d lines acknowledged", c.AckLimit, len(lines))
 	} else {
 		c.DataSent = append(c.DataSent, lines...)
-		return nil
+		return len(lines), nil
 	}
 }
 
@@ -51,10 +88,10 @@ func (c *StdoutClient) Name() string {
 	return fmt.Sprintf("StdoutClient[%p]", c)
 }
 
-func (c *StdoutClient) Send(lines []Data) error {
+func (c *StdoutClient) Send(lines []Data) (int, error) {
 	for _, data := range lines {
 		fmt.Printf("%#v\n", data)
 	}
 
-	return nil
+	return len(lines), nil
 }
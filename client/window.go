@@ -0,0 +1,62 @@
+package client
+
+// Window is a payload of lines that has been sent to a remote system, but
+// whose acknowledgement may still be pending.
+type Window struct {
+	done  chan struct{}
+	acked int
+	err   error
+}
+
+// PipelinedClient is implemented by clients that can have several windows in
+// flight at once, sending more lines before earlier ones are acknowledged.
+type PipelinedClient interface {
+	Client
+
+	// SendWindow sends lines without waiting for them to be acknowledged. It may
+	// block if too many windows are already in flight. An error is returned if
+	// the lines could not be sent at all.
+	SendWindow(lines []Data) (*Window, error)
+}
+
+func NewWindow() *Window {
+	return &Window{done: make(chan struct{})}
+}
+
+// Done is closed once the window has been acknowledged, or has failed.
+func (w *Window) Done() <-chan struct{} {
+	return w.done
+}
+
+// Result returns the number of lines, from the beginning of the window, that
+// were acknowledged. If that is fewer than all of them, err explains why. It
+// must only be called after Done is closed.
+func (w *Window) Result() (int, error) {
+	return w.acked, w.err
+}
+
+// Finish records the result of the window and closes Done. It must be called
+// exactly once.
+func (w *Window) Finish(acked int, err error) {
+	w.acked = acked
+	w.err = err
+	close(w.done)
+}
+
+// SendWindow sends lines to c without waiting for them to be acknowledged, if
+// c supports it. Otherwise, it waits for c to send them and returns a window
+// that is already done.
+func SendWindow(c Client, lines []Data) (*Window, error) {
+	if pipelined, ok := c.(PipelinedClient); ok {
+		return pipelined.SendWindow(lines)
+	}
+
+	acked, err := c.Send(lines)
+	if acked == 0 && err != nil {
+		return nil, err
+	}
+
+	window := NewWindow()
+	window.Finish(acked, err)
+	return window, nil
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
 	"time"
 
@@ -33,24 +34,11 @@ func main() {
 		os.Exit(1)
 	}
 
-	clients := make([]client.Client, 0, len(config.Network.Servers))
-	for _, server := range config.Network.Servers {
-		tlsConfig, err := config.BuildTLSConfig()
-		if err != nil {
-			fmt.Printf("%s\n", err.Error())
-			os.Exit(1)
-		}
-		tlsConfig.ServerName = server.Name
-
-		options := &lumberjack.ClientOptions{
-			Network:           "tcp",
-			Address:           server.Addr,
-			TLSConfig:         tlsConfig,
-			ConnectionTimeout: time.Duration(config.Network.Timeout) * time.Second,
-			SendTimeout:       time.Duration(config.Network.Timeout) * time.Second,
-		}
-		client := lumberjack.NewClient(options)
-		clients = append(clients, client)
+	clientsByKey := make(map[clientKey]client.Client)
+	clients, err := buildClients(config, clientsByKey)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
 	}
 
 	// clients := []Client{&StdoutClient{}}
@@ -62,6 +50,7 @@ func main() {
 	}
 	snapshotter := &butteredscones.BoltSnapshotter{DB: db}
 
+	butteredscones.GlobalStatistics.SetHealthThresholds(config.Statistics.HealthThresholds())
 	if config.Statistics.Addr != "" {
 		stats_server := &butteredscones.StatisticsServer{
 			Statistics: butteredscones.GlobalStatistics,
@@ -82,15 +71,150 @@ func main() {
 
 	supervisor := butteredscones.NewSupervisor(config.Files, clients, snapshotter, config.MaxLength)
 	supervisor.SpoolSize = spoolSize
+	supervisor.NetworkMode = config.Network.Mode
 	supervisor.GlobRefresh = 15 * time.Second
+	supervisor.MaxOpenFiles = config.MaxOpenFiles
+	supervisor.RateLimit = config.RateLimit
+	setClientRateLimits(config, clients, supervisor)
+
+	if config.DiskQueue != nil {
+		queue, err := butteredscones.NewDiskQueue(config.DiskQueue.Path, config.DiskQueue.MaxSize, config.DiskQueue.Overflow)
+		if err != nil {
+			fmt.Printf("error opening disk queue: %s\n", err.Error())
+			os.Exit(1)
+		}
+		supervisor.DiskQueue = queue
+	}
 
 	supervisor.Start()
 
 	signalCh := make(chan os.Signal, 1)
-	go signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
-
-	signal := <-signalCh
-	fmt.Printf("Received %s, shutting down cleanly ...\n", signal)
+	go signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for running := true; running; {
+		select {
+		case signal := <-signalCh:
+			if signal == syscall.SIGHUP {
+				fmt.Printf("Received %s, reloading configuration ...\n", signal)
+				config = reload(configFile, config, supervisor, clientsByKey)
+				continue
+			}
+			fmt.Printf("Received %s, shutting down cleanly ...\n", signal)
+		case <-supervisor.StdinDone():
+			fmt.Printf("Reached the end of standard input, shutting down cleanly ...\n")
+		}
+		running = false
+	}
 	supervisor.Stop()
 	fmt.Printf("Done shutting down\n")
 }
+
+// clientKey is everything a client is built from. A client is kept across
+// reloads as long as none of it changes.
+type clientKey struct {
+	Server             butteredscones.ServerConfiguration
+	Certificate        string
+	Key                string
+	CA                 string
+	Timeout            int
+	MaxWindowsInFlight int
+}
+
+// buildClients builds a client for each configured server, reusing clients in
+// existing that haven't changed. existing is updated to hold only the clients
+// that are returned.
+func buildClients(config *butteredscones.Configuration, existing map[clientKey]client.Client) ([]client.Client, error) {
+	clients := make([]client.Client, 0, len(config.Network.Servers))
+	built := make(map[clientKey]client.Client, len(config.Network.Servers))
+	for _, server := range config.Network.Servers {
+		key := clientKey{
+			Server:             server,
+			Certificate:        config.Network.Certificate,
+			Key:                config.Network.Key,
+			CA:                 config.Network.CA,
+			Timeout:            config.Network.Timeout,
+			MaxWindowsInFlight: config.Network.MaxWindowsInFlight,
+		}
+		if c, ok := existing[key]; ok {
+			clients = append(clients, c)
+			built[key] = c
+			continue
+		}
+
+		tlsConfig, err := config.BuildTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = server.Name
+
+		options := &lumberjack.ClientOptions{
+			Network:           "tcp",
+			Address:           server.Addr,
+			TLSConfig:         tlsConfig,
+			ConnectionTimeout: time.Duration(config.Network.Timeout) * time.Second,
+			SendTimeout:       time.Duration(config.Network.Timeout) * time.Second,
+			ProtocolVersion:   server.Protocol,
+
+			MaxWindowsInFlight: config.Network.MaxWindowsInFlight,
+		}
+		client := lumberjack.NewClient(options)
+		clients = append(clients, client)
+		built[key] = client
+	}
+
+	for key := range existing {
+		delete(existing, key)
+	}
+	for key, c := range built {
+		existing[key] = c
+	}
+
+	return clients, nil
+}
+
+// setClientRateLimits gives each client the rate limit of the server it was
+// built for. buildClients returns clients in the same order as the servers.
+func setClientRateLimits(config *butteredscones.Configuration, clients []client.Client, supervisor *butteredscones.Supervisor) {
+	for i, server := range config.Network.Servers {
+		supervisor.SetClientRateLimit(clients[i], server.RateLimit)
+	}
+}
+
+// reload loads the configuration file again, and hands the new file groups
+// and servers to the supervisor. It returns the configuration in effect
+// afterwards, which is the current one if the file can't be loaded. Settings
+// other than files, servers and health thresholds only take effect after a
+// restart, so they keep their current values.
+func reload(configFile string, current *butteredscones.Configuration, supervisor *butteredscones.Supervisor, clientsByKey map[clientKey]client.Client) *butteredscones.Configuration {
+	config, err := butteredscones.LoadConfiguration(configFile)
+	if err != nil {
+		fmt.Printf("error reloading configuration file: %s; keeping current configuration\n", err.Error())
+		return current
+	}
+
+	clients, err := buildClients(config, clientsByKey)
+	if err != nil {
+		fmt.Printf("error reloading configuration file: %s; keeping current configuration\n", err.Error())
+		return current
+	}
+
+	if config.State != current.State || config.Network.Mode != current.Network.Mode || config.Network.SpoolSize != current.Network.SpoolSize ||
+		config.MaxLength != current.MaxLength || config.MaxOpenFiles != current.MaxOpenFiles || config.RateLimit != current.RateLimit || config.Statistics.Addr != current.Statistics.Addr || !reflect.DeepEqual(config.DiskQueue, current.DiskQueue) {
+		fmt.Printf("only files, network servers and health thresholds are reloaded; restart to apply other changes\n")
+	}
+
+	butteredscones.GlobalStatistics.SetHealthThresholds(config.Statistics.HealthThresholds())
+	setClientRateLimits(config, clients, supervisor)
+	supervisor.Reload(config.Files, clients)
+	fmt.Printf("Done reloading configuration\n")
+
+	config.State = current.State
+	config.Network.Mode = current.Network.Mode
+	config.Network.SpoolSize = current.Network.SpoolSize
+	config.MaxLength = current.MaxLength
+	config.MaxOpenFiles = current.MaxOpenFiles
+	config.RateLimit = current.RateLimit
+	config.Statistics.Addr = current.Statistics.Addr
+	config.DiskQueue = current.DiskQueue
+	return config
+}
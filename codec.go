@@ -0,0 +1,77 @@
+package butteredscones
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/digitalocean/butteredscones/client"
+)
+
+const (
+	// Each line is sent as-is in the "line" field. This is the default.
+	CodecPlain = "plain"
+
+	// Each line is a JSON object, whose keys become fields of the event
+	CodecJSON = "json"
+
+	// Added to the "tags" of events whose line couldn't be decoded as JSON
+	jsonParseFailureTag = "_jsonparsefailure"
+)
+
+// jsonCodec decodes lines that are JSON objects into the fields of an event.
+type jsonCodec struct {
+	target    string
+	overwrite bool
+}
+
+func newCodec(config *CodecConfiguration) (*jsonCodec, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	switch config.Type {
+	case "", CodecPlain:
+		return nil, nil
+	case CodecJSON:
+		return &jsonCodec{target: config.Target, overwrite: config.OverwriteKeys}, nil
+	}
+
+	return nil, fmt.Errorf("codec must be %q or %q, got %q", CodecPlain, CodecJSON, config.Type)
+}
+
+// decode adds the keys of the JSON object in line to data. If line isn't a
+// JSON object, it is added as the "line" field instead, and the event is
+// tagged so the failure can be found downstream.
+func (c *jsonCodec) decode(line []byte, data client.Data) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err == nil {
+		// Nothing but whitespace may follow the object
+		if _, trailing := decoder.Token(); trailing != io.EOF {
+			err = fmt.Errorf("unexpected data after JSON object")
+		}
+	}
+	if err != nil || object == nil {
+		data["line"] = string(line)
+		data["tags"] = []string{jsonParseFailureTag}
+		return
+	}
+
+	if c.target != "" {
+		if _, exists := data[c.target]; !exists || c.overwrite {
+			data[c.target] = object
+		}
+		return
+	}
+
+	for k, v := range object {
+		if _, exists := data[k]; !exists || c.overwrite {
+			data[k] = v
+		}
+	}
+}
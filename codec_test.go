@@ -0,0 +1,70 @@
+package butteredscones
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/butteredscones/client"
+)
+
+func TestJSONCodec(t *testing.T) {
+	codec, err := newCodec(&CodecConfiguration{Type: CodecJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := client.Data{"host": "web1", "type": "app"}
+	codec.decode([]byte(`{"msg": "hello", "status": 200, "type": "ignored"}`), data)
+
+	expected := client.Data{"host": "web1", "type": "app", "msg": "hello", "status": json.Number("200")}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected %v, but got %v", expected, data)
+	}
+}
+
+func TestJSONCodecOverwriteKeys(t *testing.T) {
+	codec, err := newCodec(&CodecConfiguration{Type: CodecJSON, OverwriteKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := client.Data{"host": "web1"}
+	codec.decode([]byte(`{"host": "container1"}`), data)
+
+	if data["host"] != "container1" {
+		t.Fatalf("expected [\"host\"] to be %q, but got %q", "container1", data["host"])
+	}
+}
+
+func TestJSONCodecTarget(t *testing.T) {
+	codec, err := newCodec(&CodecConfiguration{Type: CodecJSON, Target: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := client.Data{"host": "web1"}
+	codec.decode([]byte(`{"host": "container1"}`), data)
+
+	expected := client.Data{"host": "web1", "app": map[string]interface{}{"host": "container1"}}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("expected %v, but got %v", expected, data)
+	}
+}
+
+func TestJSONCodecInvalid(t *testing.T) {
+	codec, err := newCodec(&CodecConfiguration{Type: CodecJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{`not json`, `["an", "array"]`, `{"a": 1} trailing`} {
+		data := client.Data{}
+		codec.decode([]byte(line), data)
+
+		expected := client.Data{"line": line, "tags": []string{jsonParseFailureTag}}
+		if !reflect.DeepEqual(data, expected) {
+			t.Fatalf("expected %v, but got %v", expected, data)
+		}
+	}
+}
@@ -8,6 +8,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	StartPositionBeginning = "beginning"
+	StartPositionEnd       = "end"
 )
 
 type Configuration struct {
@@ -16,6 +24,37 @@ type Configuration struct {
 	Statistics StatisticsConfiguration `json:"statistics"`
 	Files      []FileConfiguration     `json:"files"`
 	MaxLength  int                     `json:"max_length"`
+
+	// The most files that may be open for reading at once. Other files wait
+	// for their turn. Zero means no limit.
+	MaxOpenFiles int `json:"max_open_files"`
+
+	// Optional. If given, lines are queued on disk until they're sent.
+	DiskQueue *DiskQueueConfiguration `json:"disk_queue"`
+
+	// Optional. Limits how fast lines are sent, to all servers together.
+	RateLimit RateLimitConfiguration `json:"rate_limit"`
+}
+
+// RateLimitConfiguration limits how many events, and how many bytes of the
+// records they were read from, are sent each second. Bursts of up to a second's worth are sent right
+// away. Zero means no limit.
+type RateLimitConfiguration struct {
+	EventsPerSecond float64 `json:"events_per_second"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+}
+
+type DiskQueueConfiguration struct {
+	// The directory segment files are kept in. Defaults to a "queue" directory
+	// next to the state file.
+	Path string `json:"path"`
+
+	// The most bytes the queue may take up on disk. Zero means no limit.
+	MaxSize int64 `json:"max_size"`
+
+	// What to do when the queue is full: "block" (the default) waits for room,
+	// and "drop_oldest" drops the oldest lines in the queue.
+	Overflow string `json:"overflow"`
 }
 
 type NetworkConfiguration struct {
@@ -25,20 +64,232 @@ type NetworkConfiguration struct {
 	CA          string                `json:"ca"`
 	Timeout     int                   `json:"timeout"`
 	SpoolSize   int                   `json:"spool_size"`
+
+	// The number of windows of lines that may be sent to a server before the
+	// first of them is acknowledged. Defaults to 1.
+	MaxWindowsInFlight int `json:"max_windows_in_flight"`
+
+	// How lines are distributed between servers: "loadbalance" (the default),
+	// "failover" or "broadcast".
+	Mode string `json:"mode"`
 }
 
 type ServerConfiguration struct {
 	Addr string `json:"addr"`
 	Name string `json:"name"`
+
+	// The version of the lumberjack protocol to speak: 1 (the default) for the
+	// lumberjack input of logstash, or 2 for the beats input.
+	Protocol int `json:"protocol"`
+
+	// Optional. Limits how fast lines are sent to this server.
+	RateLimit RateLimitConfiguration `json:"rate_limit"`
 }
 
 type StatisticsConfiguration struct {
 	Addr string `json:"addr"`
+
+	// How far behind things may get before /health reports a problem. Zero
+	// disables each check.
+	MaxBytesBehind     int64 `json:"max_bytes_behind"`
+	MaxSecondsBehind   int   `json:"max_seconds_behind"`
+	MaxSecondsRetrying int   `json:"max_seconds_retrying"`
+}
+
+func (c StatisticsConfiguration) HealthThresholds() HealthThresholds {
+	return HealthThresholds{
+		MaxBytesBehind:  c.MaxBytesBehind,
+		MaxTimeBehind:   time.Duration(c.MaxSecondsBehind) * time.Second,
+		MaxTimeRetrying: time.Duration(c.MaxSecondsRetrying) * time.Second,
+	}
 }
 
 type FileConfiguration struct {
-	Paths  []string          `json:"paths"`
-	Fields map[string]string `json:"fields"`
+	// Name identifies the group in statistics. Optional; defaults to the
+	// group's paths.
+	Name string `json:"name"`
+
+	// Paths are glob patterns, where "**" matches any number of nested
+	// directories.
+	Paths []string `json:"paths"`
+
+	// Files matching any of these patterns aren't read. Patterns without a
+	// "/" are matched against file names (e.g. "*.gz"); others are matched
+	// against whole paths.
+	ExcludePaths []string `json:"exclude_paths"`
+
+	Fields    map[string]string       `json:"fields"`
+	Multiline *MultilineConfiguration `json:"multiline"`
+	Framing   *FramingConfiguration   `json:"framing"`
+
+	// The character encoding of the files, e.g. "latin1", "shift_jis" or
+	// "utf-16le". Lines are converted to UTF-8 before they are sent.
+	Encoding string `json:"encoding"`
+
+	Codec    *CodecConfiguration    `json:"codec"`
+	Metadata *MetadataConfiguration `json:"metadata"`
+
+	// Files that haven't been modified for longer than IgnoreOlder aren't read;
+	// their high water mark is moved to the end instead. Optional.
+	IgnoreOlder Duration `json:"ignore_older"`
+
+	// By default, a file is closed when the end of it is reached, and opened
+	// again once more is written to it. If CloseInactive is given, the file is
+	// kept open and checked for more lines until none have been read for this
+	// long, so lines written to it after it's renamed are read, too.
+	CloseInactive Duration `json:"close_inactive"`
+
+	// Where to start reading files that were already there when
+	// butteredscones started, or when the group was added or changed by a
+	// reload, but haven't been read before: "beginning" (the default) or
+	// "end". Files that appear later are always read from the beginning.
+	StartPosition string `json:"start_position"`
+
+	// When there's a backlog of lines to send, lines from groups with a higher
+	// Priority are sent first. Groups with the same priority share what's sent
+	// in proportion to their Weight, which defaults to 1.
+	Priority int `json:"priority"`
+	Weight   int `json:"weight"`
+
+	// The most files in this group that may be open for reading at once.
+	// Other files wait for their turn. Zero means no limit.
+	MaxOpenFiles int `json:"max_open_files"`
+
+	// Regular expressions that decide which lines are sent. If IncludeLines is
+	// given, only lines that match one of them are sent. Lines that match any
+	// of ExcludeLines aren't sent.
+	IncludeLines []string `json:"include_lines"`
+	ExcludeLines []string `json:"exclude_lines"`
+
+	// Processors transform each event read from the files, in order, before
+	// it is sent.
+	Processors []ProcessorConfiguration `json:"processors"`
+
+	// Optional. Limits how fast lines are read from the group's files, all
+	// together.
+	RateLimit RateLimitConfiguration `json:"rate_limit"`
+}
+
+// ProcessorConfiguration describes a step that transforms events. Exactly one
+// of its options must be given.
+type ProcessorConfiguration struct {
+	// AddFields sets fields on each event, replacing any that are there.
+	AddFields map[string]string `json:"add_fields"`
+
+	// RenameFields renames fields on each event, from each key to its value.
+	RenameFields map[string]string `json:"rename_fields"`
+
+	// RemoveFields removes fields from each event.
+	RemoveFields []string `json:"remove_fields"`
+
+	// DropEvents drops events with a field (each key) that matches a regular
+	// expression (its value).
+	DropEvents map[string]string `json:"drop_events"`
+}
+
+// GroupName returns the name of the file group, or its paths if it hasn't
+// been given one.
+func (c FileConfiguration) GroupName() string {
+	if c.Name != "" {
+		return c.Name
+	}
+
+	return strings.Join(c.Paths, ",")
+}
+
+// MetadataConfiguration names the fields that metadata about where each line
+// came from is added to. Each is only added if it's given a name.
+type MetadataConfiguration struct {
+	// File is the field for the path of the file the line was read from.
+	File string `json:"file"`
+
+	// Offset is the field for the byte offset in the file the line starts at.
+	Offset string `json:"offset"`
+
+	// Timestamp is the field for when the line was read, in RFC 3339 format.
+	Timestamp string `json:"timestamp"`
+}
+
+// CodecConfiguration describes how each line is turned into an event.
+type CodecConfiguration struct {
+	// Type is "plain" (the default), where each line is sent as the "line"
+	// field, or "json", where each line is a JSON object whose keys become
+	// fields.
+	Type string `json:"type"`
+
+	// Target, if set, is the field JSON objects are put under, rather than
+	// merging their keys into the event.
+	Target string `json:"target"`
+
+	// OverwriteKeys lets keys in JSON objects replace the host and the group's
+	// fields. By default, the host and fields win.
+	OverwriteKeys bool `json:"overwrite_keys"`
+}
+
+// FramingConfiguration describes how a file is split into records. By
+// default, each line is a record.
+type FramingConfiguration struct {
+	// Delimiter is the sequence of one or more bytes that ends each record,
+	// e.g. "\u0000" or "\u001e". Defaults to "\n".
+	Delimiter string `json:"delimiter"`
+
+	// LengthPrefix, if set, is the size in bytes (1, 2, 4 or 8) of an unsigned
+	// integer before each record, giving its length. It can't be used along
+	// with Delimiter.
+	LengthPrefix int `json:"length_prefix"`
+
+	// ByteOrder is the byte order of length prefixes: "big" (the default) or
+	// "little".
+	ByteOrder string `json:"byte_order"`
+}
+
+// MultilineConfiguration describes how lines that continue an event (e.g. the
+// lines of a stack trace) are joined together into a single event.
+type MultilineConfiguration struct {
+	// Pattern is a regular expression each line is matched against.
+	Pattern string `json:"pattern"`
+
+	// Negate inverts Pattern, so lines that do _not_ match it are considered
+	// continuation lines.
+	Negate bool `json:"negate"`
+
+	// What is "previous" if continuation lines belong to the event before them,
+	// or "next" if they belong to the event after them. Defaults to "previous".
+	What string `json:"what"`
+
+	// MaxLines is the most lines that will be joined into one event. Once it is
+	// reached, the event is sent and the next line starts a new one.
+	MaxLines int `json:"max_lines"`
+
+	// Timeout is how long an incomplete event waits for more lines before it is
+	// sent as-is.
+	Timeout Duration `json:"timeout"`
+}
+
+// Duration is a time.Duration that can be configured either as a number of
+// seconds (e.g. 15) or as a string (e.g. "1.5s" or "250ms").
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+
+	return nil
 }
 
 func LoadConfiguration(configFile string) (*Configuration, error) {
@@ -55,9 +306,91 @@ func LoadConfiguration(configFile string) (*Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if configuration.Network.Mode == "" {
+		configuration.Network.Mode = NetworkModeLoadBalance
+	}
+	if err = validNetworkMode(configuration.Network.Mode); err != nil {
+		return nil, err
+	}
+
+	if err = validRateLimit(configuration.RateLimit); err != nil {
+		return nil, err
+	}
+	for _, server := range configuration.Network.Servers {
+		if err = validRateLimit(server.RateLimit); err != nil {
+			return nil, err
+		}
+		switch server.Protocol {
+		case 0, 1, 2:
+		default:
+			return nil, fmt.Errorf("protocol must be 1 or 2, got %d", server.Protocol)
+		}
+	}
+
+	for _, file := range configuration.Files {
+		encoding, err := newCharacterEncoding(file.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = newFraming(file.Framing, encoding); err != nil {
+			return nil, err
+		}
+		if _, err = newCodec(file.Codec); err != nil {
+			return nil, err
+		}
+		if _, err = NewProcessors(file.Processors); err != nil {
+			return nil, err
+		}
+		if _, err = newLineFilter(file.IncludeLines, file.ExcludeLines); err != nil {
+			return nil, err
+		}
+		if file.Multiline != nil {
+			if _, err = newMultiline(file.Multiline); err != nil {
+				return nil, err
+			}
+		}
+		if err = validRateLimit(file.RateLimit); err != nil {
+			return nil, err
+		}
+		if file.Weight < 0 {
+			return nil, fmt.Errorf("weight must not be negative, got %d", file.Weight)
+		}
+		switch file.StartPosition {
+		case "", StartPositionBeginning, StartPositionEnd:
+		default:
+			return nil, fmt.Errorf("start_position must be %q or %q, got %q", StartPositionBeginning, StartPositionEnd, file.StartPosition)
+		}
+		for _, pattern := range file.ExcludePaths {
+			if _, err = filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid exclude_paths pattern %q: %s", pattern, err)
+			}
+		}
+	}
+
+	if queue := configuration.DiskQueue; queue != nil {
+		if queue.Path == "" {
+			queue.Path = filepath.Join(filepath.Dir(configuration.State), "queue")
+		}
+		if queue.Overflow == "" {
+			queue.Overflow = DiskQueueOverflowBlock
+		}
+		if queue.Overflow != DiskQueueOverflowBlock && queue.Overflow != DiskQueueOverflowDropOldest {
+			return nil, fmt.Errorf("disk_queue overflow must be %q or %q, got %q", DiskQueueOverflowBlock, DiskQueueOverflowDropOldest, queue.Overflow)
+		}
+	}
+
 	return configuration, nil
 }
 
+func validRateLimit(limit RateLimitConfiguration) error {
+	if limit.EventsPerSecond < 0 || limit.BytesPerSecond < 0 {
+		return fmt.Errorf("rate_limit must not be negative, got %v events and %v bytes per second", limit.EventsPerSecond, limit.BytesPerSecond)
+	}
+
+	return nil
+}
+
 func (c *Configuration) BuildTLSConfig() (*tls.Config, error) {
 	if c.Network.Certificate == "" || c.Network.Key == "" {
 		return nil, fmt.Errorf("certificate and key not specified")
@@ -0,0 +1,569 @@
+package butteredscones
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/butteredscones/client"
+	"github.com/technoweenie/grohl"
+)
+
+const (
+	// When the disk queue is full, wait for space to be freed up
+	DiskQueueOverflowBlock = "block"
+
+	// When the disk queue is full, drop the oldest lines in it to make space
+	DiskQueueOverflowDropOldest = "drop_oldest"
+)
+
+const (
+	// A new segment is started once the last one reaches this size, or a
+	// quarter of the queue's maximum size if that's smaller. The queue can only
+	// drop whole segments when it overflows.
+	diskQueueSegmentSize = 16 * 1024 * 1024
+
+	diskQueueSegmentExt = ".seg"
+	diskQueueAckFile    = "ack"
+
+	// Each record is preceded by its length, a CRC32 of its contents, and the
+	// number of lines in it
+	diskQueueRecordHeaderSize = 12
+)
+
+var ErrDiskQueueClosed = errors.New("disk queue closed")
+
+// DiskQueue is a first-in, first-out queue of chunks of lines, kept in segment
+// files in a directory so that it survives restarts. Once lines are pushed to
+// the queue, they don't need to be read from their files again.
+//
+// Records are assigned sequential IDs as they are pushed. They may be
+// acknowledged in any order, but a segment is only deleted once every record
+// in it has been acknowledged. If the process stops, records that weren't
+// acknowledged are read again when the queue is reopened.
+type DiskQueue struct {
+	dir      string
+	maxSize  int64
+	overflow string
+
+	segmentSize int64
+
+	// Guards everything below, and is signalled when records are pushed or
+	// acknowledged, or the queue is closed
+	lock   sync.Mutex
+	cond   *sync.Cond
+	closed bool
+
+	// Oldest first. Only the last one is written to.
+	segments []*diskQueueSegment
+	size     int64
+
+	// The ID of the next record that will be pushed
+	nextID uint64
+	// The ID of the next record that will be returned by Next
+	readID uint64
+	// Every record before this ID has been acknowledged
+	ackedID uint64
+	// Records at or after ackedID that have been acknowledged
+	acked map[uint64]bool
+}
+
+type DiskQueueRecord struct {
+	ID    uint64
+	Lines []client.Data
+}
+
+type diskQueueSegment struct {
+	path    string
+	firstID uint64
+	size    int64
+
+	// The offset of, and number of lines in, each record in the segment
+	offsets []int64
+	lines   []int
+
+	// Only open for the segment being written to
+	file *os.File
+}
+
+func NewDiskQueue(dir string, maxSize int64, overflow string) (*DiskQueue, error) {
+	switch overflow {
+	case "":
+		overflow = DiskQueueOverflowBlock
+	case DiskQueueOverflowBlock, DiskQueueOverflowDropOldest:
+	default:
+		return nil, fmt.Errorf("disk queue overflow must be %q or %q, got %q", DiskQueueOverflowBlock, DiskQueueOverflowDropOldest, overflow)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{
+		dir:         dir,
+		maxSize:     maxSize,
+		overflow:    overflow,
+		segmentSize: diskQueueSegmentSize,
+		acked:       make(map[uint64]bool),
+	}
+	if maxSize > 0 && maxSize/4 < q.segmentSize {
+		q.segmentSize = maxSize / 4
+	}
+	q.cond = sync.NewCond(&q.lock)
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	q.updateStatistics()
+
+	return q, nil
+}
+
+// Push adds a chunk of lines to the end of the queue, and makes sure it is on
+// disk before returning. If the queue is full, it either waits for room or
+// drops the oldest records, depending on how the queue overflows.
+func (q *DiskQueue) Push(lines []client.Data) error {
+	payload, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+
+	record := new(bytes.Buffer)
+	binary.Write(record, binary.BigEndian, uint32(len(payload)))
+	binary.Write(record, binary.BigEndian, crc32.ChecksumIEEE(payload))
+	binary.Write(record, binary.BigEndian, uint32(len(lines)))
+	record.Write(payload)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for !q.closed && q.maxSize > 0 && q.size > 0 && q.size+int64(record.Len()) > q.maxSize {
+		if q.overflow == DiskQueueOverflowDropOldest {
+			if err := q.dropOldest(); err != nil {
+				return err
+			}
+		} else {
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return ErrDiskQueueClosed
+	}
+
+	segment, err := q.writableSegment()
+	if err != nil {
+		return err
+	}
+
+	if _, err := segment.file.Write(record.Bytes()); err != nil {
+		return err
+	}
+	if err := segment.file.Sync(); err != nil {
+		return err
+	}
+
+	segment.offsets = append(segment.offsets, segment.size)
+	segment.lines = append(segment.lines, len(lines))
+	segment.size += int64(record.Len())
+	q.size += int64(record.Len())
+	q.nextID += 1
+
+	q.cond.Broadcast()
+	q.updateStatistics()
+	return nil
+}
+
+// Next returns the next record in the queue, waiting for one to be pushed if
+// necessary. Records returned by Next are still in the queue until they are
+// acknowledged.
+func (q *DiskQueue) Next() (*DiskQueueRecord, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		for !q.closed && q.readID >= q.nextID {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return nil, ErrDiskQueueClosed
+		}
+
+		id := q.readID
+		q.readID += 1
+
+		record, err := q.readRecord(id)
+		if err == nil {
+			return record, nil
+		}
+
+		// A record that can't be read never will be. Skip it rather than
+		// holding up everything after it.
+		grohl.Report(err, grohl.Data{"ns": "DiskQueue", "fn": "Next", "id": id, "msg": "failed to read record", "resolution": "skipping record"})
+		q.acked[id] = true
+		if q.advanceAckedID() {
+			q.cond.Broadcast()
+		}
+	}
+}
+
+// Ack acknowledges that a record has been sent, so it no longer needs to be
+// kept.
+func (q *DiskQueue) Ack(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if id < q.ackedID {
+		// Already dropped
+		return nil
+	}
+
+	q.acked[id] = true
+	if !q.advanceAckedID() {
+		return nil
+	}
+	q.cond.Broadcast()
+
+	if err := q.removeAckedSegments(); err != nil {
+		return err
+	}
+	if err := q.writeAckedID(); err != nil {
+		return err
+	}
+
+	q.updateStatistics()
+	return nil
+}
+
+// WaitForAcks waits until every record pushed so far has been acknowledged,
+// or dropped to make room.
+func (q *DiskQueue) WaitForAcks() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	id := q.nextID
+	for !q.closed && q.ackedID < id {
+		q.cond.Wait()
+	}
+	if q.ackedID < id {
+		return ErrDiskQueueClosed
+	}
+
+	return nil
+}
+
+// advanceAckedID moves ackedID past records that have been acknowledged,
+// returning true if it moved. The caller must hold lock.
+func (q *DiskQueue) advanceAckedID() bool {
+	advanced := false
+	for q.acked[q.ackedID] {
+		delete(q.acked, q.ackedID)
+		q.ackedID += 1
+		advanced = true
+	}
+
+	return advanced
+}
+
+// Close wakes up anything waiting on the queue, and closes the segment being
+// written to.
+func (q *DiskQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+
+	if len(q.segments) > 0 {
+		if segment := q.segments[len(q.segments)-1]; segment.file != nil {
+			err := segment.file.Close()
+			segment.file = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the segments already in the queue's directory.
+func (q *DiskQueue) load() error {
+	ackedID, err := q.readAckedID()
+	if err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*"+diskQueueSegmentExt))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		firstID, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), diskQueueSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segment := &diskQueueSegment{path: path, firstID: firstID}
+		if err := segment.scan(); err != nil {
+			return err
+		}
+		q.segments = append(q.segments, segment)
+	}
+	sort.Sort(diskQueueSegmentsByID(q.segments))
+
+	q.ackedID = ackedID
+	if len(q.segments) > 0 {
+		first := q.segments[0]
+		last := q.segments[len(q.segments)-1]
+		if first.firstID > q.ackedID {
+			// Records before the first segment were dropped
+			q.ackedID = first.firstID
+		}
+		q.nextID = last.firstID + uint64(len(last.offsets))
+	} else {
+		q.nextID = q.ackedID
+	}
+	if q.nextID < q.ackedID {
+		q.nextID = q.ackedID
+	}
+	q.readID = q.ackedID
+
+	for _, segment := range q.segments {
+		q.size += segment.size
+	}
+
+	return q.removeAckedSegments()
+}
+
+// scan reads the records in a segment file, truncating it after the last
+// complete record in case the process stopped while one was being written.
+func (s *diskQueueSegment) scan() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, diskQueueRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		lines := binary.BigEndian.Uint32(header[8:12])
+
+		payload := make([]byte, int(length))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+
+		s.offsets = append(s.offsets, s.size)
+		s.lines = append(s.lines, int(lines))
+		s.size += int64(diskQueueRecordHeaderSize + len(payload))
+	}
+
+	return file.Truncate(s.size)
+}
+
+func (s *diskQueueSegment) lastID() uint64 {
+	return s.firstID + uint64(len(s.offsets)) - 1
+}
+
+// writableSegment returns the segment new records should be written to,
+// starting a new one if the last one is full. The caller must hold lock.
+func (q *DiskQueue) writableSegment() (*diskQueueSegment, error) {
+	if len(q.segments) > 0 {
+		last := q.segments[len(q.segments)-1]
+		if last.file != nil && last.size < q.segmentSize {
+			return last, nil
+		}
+		if last.file != nil {
+			last.file.Close()
+			last.file = nil
+		}
+	}
+
+	segment := &diskQueueSegment{
+		path:    filepath.Join(q.dir, fmt.Sprintf("%020d%s", q.nextID, diskQueueSegmentExt)),
+		firstID: q.nextID,
+	}
+
+	file, err := os.OpenFile(segment.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	segment.file = file
+
+	q.segments = append(q.segments, segment)
+	return segment, nil
+}
+
+// readRecord reads the record with the given ID from its segment. The caller
+// must hold lock.
+func (q *DiskQueue) readRecord(id uint64) (*DiskQueueRecord, error) {
+	for _, segment := range q.segments {
+		if len(segment.offsets) == 0 || id < segment.firstID || id > segment.lastID() {
+			continue
+		}
+
+		file, err := os.Open(segment.path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if _, err := file.Seek(segment.offsets[id-segment.firstID], os.SEEK_SET); err != nil {
+			return nil, err
+		}
+
+		header := make([]byte, diskQueueRecordHeaderSize)
+		if _, err := io.ReadFull(file, header); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, int(binary.BigEndian.Uint32(header[0:4])))
+		if _, err := io.ReadFull(file, payload); err != nil {
+			return nil, err
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.UseNumber()
+
+		record := &DiskQueueRecord{ID: id}
+		if err := decoder.Decode(&record.Lines); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+
+	return nil, fmt.Errorf("disk queue record %d not found", id)
+}
+
+// dropOldest deletes the oldest segment to make room, whether or not its
+// records have been acknowledged. The caller must hold lock.
+func (q *DiskQueue) dropOldest() error {
+	if len(q.segments) == 0 {
+		return nil
+	}
+
+	oldest := q.segments[0]
+	if oldest.file != nil {
+		// It's the only segment, so new records will have to go in a new one
+		oldest.file.Close()
+		oldest.file = nil
+	}
+
+	droppedLines := 0
+	for i, lines := range oldest.lines {
+		if oldest.firstID+uint64(i) >= q.ackedID {
+			droppedLines += lines
+		}
+	}
+	grohl.Log(grohl.Data{"ns": "DiskQueue", "fn": "dropOldest", "segment": oldest.path, "lines": droppedLines, "msg": "disk queue full", "resolution": "dropping oldest lines"})
+	GlobalStatistics.IncrementDiskQueueLinesDropped(droppedLines)
+
+	if err := os.Remove(oldest.path); err != nil {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.size -= oldest.size
+
+	if len(oldest.offsets) > 0 {
+		if next := oldest.lastID() + 1; next > q.ackedID {
+			for id := q.ackedID; id < next; id++ {
+				delete(q.acked, id)
+			}
+			q.ackedID = next
+		}
+	}
+	if q.readID < q.ackedID {
+		q.readID = q.ackedID
+	}
+
+	q.updateStatistics()
+	return q.writeAckedID()
+}
+
+// removeAckedSegments deletes segments whose records have all been
+// acknowledged. The caller must hold lock.
+func (q *DiskQueue) removeAckedSegments() error {
+	for len(q.segments) > 0 {
+		oldest := q.segments[0]
+		if len(oldest.offsets) > 0 && oldest.lastID() >= q.ackedID {
+			break
+		}
+		if len(oldest.offsets) == 0 && oldest.file != nil {
+			// Nothing has been written to it yet
+			break
+		}
+
+		if oldest.file != nil {
+			oldest.file.Close()
+			oldest.file = nil
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+		q.size -= oldest.size
+	}
+
+	return nil
+}
+
+func (q *DiskQueue) readAckedID() (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.dir, diskQueueAckFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// writeAckedID saves ackedID, so acknowledged records aren't sent again if the
+// process restarts. The caller must hold lock.
+func (q *DiskQueue) writeAckedID() error {
+	path := filepath.Join(q.dir, diskQueueAckFile)
+	tmpPath := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatUint(q.ackedID, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// The caller must hold lock.
+func (q *DiskQueue) updateStatistics() {
+	lines := 0
+	for _, segment := range q.segments {
+		for i, segmentLines := range segment.lines {
+			if segment.firstID+uint64(i) >= q.ackedID && !q.acked[segment.firstID+uint64(i)] {
+				lines += segmentLines
+			}
+		}
+	}
+
+	GlobalStatistics.UpdateDiskQueueStatistics(q.size, lines)
+}
+
+type diskQueueSegmentsByID []*diskQueueSegment
+
+func (s diskQueueSegmentsByID) Len() int           { return len(s) }
+func (s diskQueueSegmentsByID) Less(i, j int) bool { return s[i].firstID < s[j].firstID }
+func (s diskQueueSegmentsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
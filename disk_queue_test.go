@@ -0,0 +1,163 @@
+package butteredscones
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/butteredscones/client"
+)
+
+func TestDiskQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	queue, err := NewDiskQueue(tmpDir, 0, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"line1", "line2"} {
+		if err := queue.Push([]client.Data{client.Data{"line": line}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Lines[0]["line"] != "line1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", first.Lines[0]["line"])
+	}
+
+	second, err := queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Lines[0]["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", second.Lines[0]["line"])
+	}
+
+	// Only the second record is acknowledged. Only acknowledgements of every
+	// record up to a point are saved, so both are read again when the queue is
+	// reopened.
+	if err := queue.Ack(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	queue.Close()
+
+	queue, err = NewDiskQueue(tmpDir, 0, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	record, err := queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lines[0]["line"] != "line1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", record.Lines[0]["line"])
+	}
+
+	if err := queue.Ack(record.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err = queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lines[0]["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", record.Lines[0]["line"])
+	}
+
+	if err := queue.Ack(record.ID); err != nil {
+		t.Fatal(err)
+	}
+	if queue.size != 0 {
+		t.Fatalf("expected acknowledged segments to be removed, but %d bytes remain", queue.size)
+	}
+}
+
+func TestDiskQueueDropOldest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Only room for one record at a time
+	queue, err := NewDiskQueue(tmpDir, 40, DiskQueueOverflowDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	for _, line := range []string{"line1", "line2"} {
+		if err := queue.Push([]client.Data{client.Data{"line": line}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lines[0]["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", record.Lines[0]["line"])
+	}
+}
+
+func TestDiskQueueBlock(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Only room for one record at a time
+	queue, err := NewDiskQueue(tmpDir, 40, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if err := queue.Push([]client.Data{client.Data{"line": "line1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.Push([]client.Data{client.Data{"line": "line2"}})
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatalf("expected push to block while the queue is full")
+	case <-time.After(100 * time.Millisecond):
+		// still blocked
+	}
+
+	record, err := queue.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Ack(record.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected push to finish once the queue had room")
+	}
+}
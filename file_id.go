@@ -0,0 +1,40 @@
+package butteredscones
+
+import (
+	"fmt"
+	"os"
+)
+
+// FileID identifies a file by the device and inode (or the platform's
+// equivalent) it lives on, rather than by its path. A file that is renamed,
+// e.g. by logrotate, keeps its FileID; a new file created at the old path gets
+// a new one.
+type FileID struct {
+	Device uint64
+	Inode  uint64
+}
+
+func (id FileID) String() string {
+	return fmt.Sprintf("%d:%d", id.Device, id.Inode)
+}
+
+// fileIDAt returns the FileID of the file at a path.
+func fileIDAt(filePath string) (FileID, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return FileID{}, err
+	}
+	defer file.Close()
+
+	return statFileID(file)
+}
+
+// parseFileID parses a FileID formatted by String.
+func parseFileID(s string) (FileID, error) {
+	var id FileID
+	if _, err := fmt.Sscanf(s, "%d:%d", &id.Device, &id.Inode); err != nil {
+		return FileID{}, fmt.Errorf("invalid file ID %q: %s", s, err)
+	}
+
+	return id, nil
+}
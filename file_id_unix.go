@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package butteredscones
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func statFileID(file *os.File) (FileID, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return FileID{}, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, fmt.Errorf("unable to determine device and inode of %q", file.Name())
+	}
+
+	return FileID{Device: uint64(stat.Dev), Inode: uint64(stat.Ino)}, nil
+}
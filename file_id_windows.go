@@ -0,0 +1,18 @@
+package butteredscones
+
+import (
+	"os"
+	"syscall"
+)
+
+func statFileID(file *os.File) (FileID, error) {
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(syscall.Handle(file.Fd()), &info); err != nil {
+		return FileID{}, err
+	}
+
+	return FileID{
+		Device: uint64(info.VolumeSerialNumber),
+		Inode:  uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow),
+	}, nil
+}
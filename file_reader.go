@@ -2,17 +2,28 @@ package butteredscones
 
 import (
 	"bufio"
-	"bytes"
 	"io"
 	"os"
+	"time"
 
 	"github.com/digitalocean/butteredscones/client"
 	"github.com/technoweenie/grohl"
 )
 
+const (
+	// How often to check for more data when waiting on an incomplete multiline
+	// event at EOF.
+	fileReaderPollInterval = 100 * time.Millisecond
+)
+
 type FileData struct {
 	client.Data
 	*HighWaterMark
+
+	// The length in bytes of the record the event was read from. Byte rate
+	// limits and statistics count this, since codecs and processors may not
+	// leave a "line" field.
+	Length int64
 }
 
 type FileReader struct {
@@ -21,33 +32,181 @@ type FileReader struct {
 	MaxLength int
 
 	file     *os.File
+	fileID   FileID
 	filePath string
 	fields   map[string]string
 
 	position int64
 	buf      *bufio.Reader
+	framing  framing
+	encoding *characterEncoding
+	codec    *jsonCodec
+	metadata *MetadataConfiguration
+	filter   *lineFilter
+	// A record that has been partially written, held until the rest of it is
+	// written
+	partial []byte
+
+	multiline *multiline
+
+	// Streams (like standard input) are read until EOF, without seeking or
+	// high water marks. buf reads them through streamReader.
+	stream       bool
+	streamReader *streamReader
+
+	// How long to keep checking for more lines at EOF before giving up, and
+	// when a line was last read
+	closeInactive time.Duration
+	lastRead      time.Time
+
+	// When the reader was created
+	openedAt time.Time
 
 	hostname string
+
+	// Closed by Stop
+	stop chan interface{}
+
+	// Closed once C is closed
+	done chan interface{}
+
+	// Signaled whenever a chunk is sent on C, or C is closed
+	notify chan<- interface{}
+}
+
+type FileReaderOptions struct {
+	Fields    map[string]string
+	ChunkSize int
+
+	// Lines longer than MaxLength are skipped. Optional.
+	MaxLength int
+
+	// Multiline joins continuation lines into a single event. Optional.
+	Multiline *MultilineConfiguration
+
+	// Framing splits the file into records other than lines. Optional.
+	Framing *FramingConfiguration
+
+	// Encoding is the file's character encoding, which records are converted
+	// from to UTF-8. Optional; by default, records are sent as they are.
+	Encoding string
+
+	// Codec decodes each line into fields. Optional; by default, each line is
+	// sent as the "line" field.
+	Codec *CodecConfiguration
+
+	// Metadata names the fields that the file's path, the offset of each line
+	// and the time it was read are added to. Optional.
+	Metadata *MetadataConfiguration
+
+	// Lines are only sent if they match one of IncludeLines (if given) and
+	// none of ExcludeLines. Lines that aren't sent still move the high water
+	// mark forward. Optional.
+	IncludeLines []string
+	ExcludeLines []string
+
+	// Notify is signaled, without blocking, whenever a chunk is sent on C or C
+	// is closed. Optional.
+	Notify chan<- interface{}
+
+	// CloseInactive is how long to keep checking for more lines at EOF, since
+	// the last line was read. By default, C is closed as soon as EOF is
+	// reached. Optional.
+	CloseInactive time.Duration
+
+	// Stream is set when the file is a pipe or terminal, like standard input,
+	// rather than a regular file. Streams aren't seekable, so lines read from
+	// them don't have high water marks. Reaching EOF means the stream has
+	// ended, so a trailing partial line is sent rather than held back.
+	Stream bool
 }
 
 func NewFileReader(file *os.File, fields map[string]string, chunkSize, maxLength int) (*FileReader, error) {
-	position, err := file.Seek(0, os.SEEK_CUR)
+	return NewFileReaderWithOptions(file, &FileReaderOptions{
+		Fields:    fields,
+		ChunkSize: chunkSize,
+		MaxLength: maxLength,
+	})
+}
+
+func NewFileReaderWithOptions(file *os.File, options *FileReaderOptions) (*FileReader, error) {
+	var position int64
+	var err error
+	if !options.Stream {
+		position, err = file.Seek(0, os.SEEK_CUR)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fileID, err := statFileID(file)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, err := newCharacterEncoding(options.Encoding)
 	if err != nil {
 		return nil, err
 	}
 
+	framing, err := newFraming(options.Framing, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := newCodec(options.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := newLineFilter(options.IncludeLines, options.ExcludeLines)
+	if err != nil {
+		return nil, err
+	}
+
+	var multiline *multiline
+	if options.Multiline != nil {
+		if multiline, err = newMultiline(options.Multiline); err != nil {
+			return nil, err
+		}
+	}
+
 	hostname, _ := os.Hostname()
+	stop := make(chan interface{})
+
+	var source io.Reader = file
+	var stream *streamReader
+	if options.Stream {
+		stream = newStreamReader(file, stop)
+		source = stream
+	}
 
 	reader := &FileReader{
 		C:         make(chan []*FileData, 1),
-		ChunkSize: chunkSize,
-		MaxLength: maxLength,
+		ChunkSize: options.ChunkSize,
+		MaxLength: options.MaxLength,
 		file:      file,
+		fileID:    fileID,
 		filePath:  file.Name(),
-		fields:    fields,
+		fields:    options.Fields,
 		position:  position,
-		buf:       bufio.NewReader(file),
+		buf:       bufio.NewReader(source),
+		framing:   framing,
+		encoding:  encoding,
+		codec:     codec,
+		metadata:  options.Metadata,
+		filter:    filter,
+		multiline: multiline,
+		stream:    options.Stream,
 		hostname:  hostname,
+		stop:      stop,
+		done:      make(chan interface{}),
+		notify:    options.Notify,
+
+		streamReader:  stream,
+		closeInactive: options.CloseInactive,
+		lastRead:      time.Now(),
+		openedAt:      time.Now(),
 	}
 	go reader.read()
 
@@ -56,65 +215,329 @@ func NewFileReader(file *os.File, fields map[string]string, chunkSize, maxLength
 
 func (h *FileReader) read() {
 	logger := grohl.NewContext(grohl.Data{"ns": "FileReader", "file_path": h.filePath})
+	defer func() {
+		select {
+		case <-h.stop:
+			h.file.Close()
+		default:
+		}
+	}()
 
 	currentChunk := make([]*FileData, 0, h.ChunkSize)
 	for {
-		line, err := h.buf.ReadBytes('\n')
+		if h.stream && !h.isLineBuffered() {
+			// Reading from a stream blocks until more is written to it, which
+			// could be a while. Don't hold on to lines in the meantime.
+			if !h.sendChunk(currentChunk) {
+				return
+			}
+			currentChunk = make([]*FileData, 0, h.ChunkSize)
+
+			// A multiline event that's waiting for more lines is sent once it
+			// times out, even if nothing more is written in the meantime
+			for h.multiline != nil && h.multiline.Pending() && !h.streamReader.Wait(fileReaderPollInterval) {
+				if isClosed(h.stop) {
+					return
+				}
+				if h.multiline.Expired() {
+					if !h.sendChunk(h.appendMultilineFlush(nil)) {
+						return
+					}
+				}
+			}
+		}
+
+		line, err := h.readLine()
+		if err == io.EOF && h.stream && len(h.partial) > 0 {
+			// The stream has ended, so the rest of the record will never come
+			line, err = h.partial, nil
+			h.partial = nil
+			if _, ok := h.framing.(*lengthPrefixFraming); ok {
+				logger.Log(grohl.Data{"status": "incomplete record", "length": len(line), "resolution": "skipping record"})
+				continue
+			}
+		}
 		if err != nil {
 			if err != io.EOF {
 				logger.Report(err, grohl.Data{"msg": "error reading file", "resolution": "closing file"})
 			}
 
-			h.sendChunk(currentChunk)
-			close(h.C)
+			if err == io.EOF && !h.stream && h.multiline != nil && h.multiline.Pending() {
+				if !h.multiline.Expired() {
+					// Give the rest of the event a chance to be written before giving
+					// up on it. Complete events shouldn't wait in the meantime.
+					if !h.sendChunk(currentChunk) {
+						return
+					}
+					currentChunk = make([]*FileData, 0, h.ChunkSize)
+
+					time.Sleep(fileReaderPollInterval)
+					continue
+				}
+			}
+			currentChunk = h.appendMultilineFlush(currentChunk)
+
+			if !h.sendChunk(currentChunk) {
+				return
+			}
+			currentChunk = make([]*FileData, 0, h.ChunkSize)
+
+			if err == io.EOF && h.isTruncated(logger) {
+				if h.rewind(logger) {
+					continue
+				}
+			}
+			if err == io.EOF && h.waitForMore() {
+				continue
+			}
+			h.finish()
 
 			return
 		}
+		start := h.position
 		h.position += int64(len(line))
+		h.lastRead = time.Now()
 		// if maxLength is configured, skip lines that are too long
 		if h.MaxLength > 0 && len(line) > h.MaxLength {
+			GlobalStatistics.IncrementLinesSkipped(1)
 			continue
 		}
 
-		fileData := &FileData{
-			Data: h.buildDataWithLine(bytes.TrimRight(line, "\r\n")),
-			HighWaterMark: &HighWaterMark{
-				FilePath: h.filePath,
-				Position: h.position,
-			},
+		if start == 0 {
+			line = h.encoding.trimBOM(line)
+		}
+		line = h.framing.content(line)
+		if h.multiline != nil {
+			for _, event := range h.multiline.Add(line, start, h.position) {
+				currentChunk = append(currentChunk, h.buildFileData(event.Line, event.Start, event.Position))
+			}
+		} else {
+			currentChunk = append(currentChunk, h.buildFileData(line, start, h.position))
 		}
-		currentChunk = append(currentChunk, fileData)
 
 		if len(currentChunk) >= h.ChunkSize {
-			h.sendChunk(currentChunk)
+			if !h.sendChunk(currentChunk) {
+				return
+			}
 			currentChunk = make([]*FileData, 0, h.ChunkSize)
+
+			// The file may have been truncated while we were reading it; if so,
+			// whatever is left in the buffer is stale.
+			if h.isTruncated(logger) {
+				if !h.sendChunk(h.appendMultilineFlush(currentChunk)) {
+					return
+				}
+				currentChunk = make([]*FileData, 0, h.ChunkSize)
+
+				if !h.rewind(logger) {
+					h.finish()
+					return
+				}
+			}
 		}
 	}
 }
 
+// readLine returns the next complete record, including its delimiter or
+// length prefix. A record that is only partially written when EOF is reached
+// is held back until the rest of it is read.
+func (h *FileReader) readLine() ([]byte, error) {
+	line, err := h.framing.readRecord(h.buf, h.partial)
+	if err != nil {
+		h.partial = line
+		return nil, err
+	}
+
+	h.partial = nil
+	return line, nil
+}
+
+// isLineBuffered returns true if a complete record can be read without
+// reading from the underlying file.
+func (h *FileReader) isLineBuffered() bool {
+	buffered, _ := h.buf.Peek(h.buf.Buffered())
+	return h.framing.isBuffered(h.partial, buffered)
+}
+
+// waitForMore waits a moment at EOF before checking for more lines, unless
+// no lines have been read for longer than closeInactive. It returns false if
+// the reader should give up on the file instead.
+func (h *FileReader) waitForMore() bool {
+	if h.stream || h.closeInactive <= 0 || time.Since(h.lastRead) >= h.closeInactive {
+		return false
+	}
+
+	select {
+	case <-h.stop:
+		return false
+	case <-time.After(fileReaderPollInterval):
+		return true
+	}
+}
+
+// isTruncated checks whether the file has been truncated in place (e.g. by
+// logrotate's copytruncate) to a size smaller than the current position.
+func (h *FileReader) isTruncated(logger *grohl.Context) bool {
+	if h.stream {
+		return false
+	}
+
+	stat, err := h.file.Stat()
+	if err != nil || stat.Size() >= h.position {
+		return false
+	}
+
+	logger.Log(grohl.Data{"status": "truncated", "position": h.position, "size": stat.Size(), "resolution": "reading from beginning"})
+	GlobalStatistics.IncrementFileTruncations(h.fileID, h.filePath)
+
+	return true
+}
+
+// rewind starts reading over from the beginning of the file.
+func (h *FileReader) rewind(logger *grohl.Context) bool {
+	if _, err := h.file.Seek(0, os.SEEK_SET); err != nil {
+		logger.Report(err, grohl.Data{"msg": "failed to seek to beginning of truncated file", "resolution": "closing file"})
+		return false
+	}
+	h.position = 0
+	h.partial = nil
+	h.buf.Reset(h.file)
+
+	return true
+}
+
+// appendMultilineFlush appends whatever multiline event is pending to chunk,
+// complete or not.
+func (h *FileReader) appendMultilineFlush(chunk []*FileData) []*FileData {
+	if h.multiline != nil {
+		if event := h.multiline.Flush(); event != nil {
+			chunk = append(chunk, h.buildFileData(event.Line, event.Start, event.Position))
+		}
+	}
+
+	return chunk
+}
+
 func (h *FileReader) FilePath() string {
 	return h.filePath
 }
 
-func (h *FileReader) sendChunk(chunk []*FileData) {
+// FileID identifies the file being read, even if it has been renamed since it
+// was opened.
+func (h *FileReader) FileID() FileID {
+	return h.fileID
+}
+
+// Ready returns true if a chunk can be taken from C without blocking, or C
+// has been closed.
+func (h *FileReader) Ready() bool {
+	if len(h.C) > 0 {
+		return true
+	}
+
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish closes C once there's nothing more to read.
+func (h *FileReader) finish() {
+	close(h.C)
+	close(h.done)
+	h.signal()
+}
+
+// signal lets whoever is waiting on Notify know C is ready.
+func (h *FileReader) signal() {
+	if h.notify == nil {
+		return
+	}
+
+	select {
+	case h.notify <- nil:
+	default:
+	}
+}
+
+// Stop stops reading the file and closes it. Lines that have been read but
+// not taken from C are discarded.
+func (h *FileReader) Stop() {
+	close(h.stop)
+}
+
+// sendChunk sends a chunk on C, returning false if the reader was stopped
+// instead.
+func (h *FileReader) sendChunk(chunk []*FileData) bool {
 	if len(chunk) > 0 {
-		h.C <- chunk
+		select {
+		case <-h.stop:
+			return false
+		case h.C <- chunk:
+			h.signal()
+		}
 	}
+
+	return true
+}
+
+// buildFileData builds the event for a line that starts at start and ends at
+// position in the file.
+//
+// Lines that are filtered out have no data, only a high water mark, so that
+// progress through the file still moves past them.
+func (h *FileReader) buildFileData(line []byte, start, position int64) *FileData {
+	fileData := &FileData{Length: int64(len(line))}
+	if h.filter.Allow(line) {
+		fileData.Data = h.buildDataWithLine(line, start)
+	} else {
+		GlobalStatistics.IncrementFileLinesFiltered(h.fileID, h.filePath, 1)
+	}
+
+	if !h.stream {
+		fileData.HighWaterMark = &HighWaterMark{
+			FileID:   h.fileID,
+			FilePath: h.filePath,
+			Position: position,
+		}
+	}
+
+	return fileData
 }
 
-func (h *FileReader) buildDataWithLine(line []byte) client.Data {
+func (h *FileReader) buildDataWithLine(line []byte, start int64) client.Data {
 	var data client.Data
 	if h.fields != nil {
 		data = make(client.Data, len(h.fields)+1)
 	} else {
 		data = make(client.Data, 2)
 	}
-	data["line"] = string(line)
+	if h.codec == nil {
+		data["line"] = string(line)
+	}
 	data["host"] = h.hostname
 
 	for k, v := range h.fields {
 		data[k] = v
 	}
 
+	if h.metadata != nil {
+		if h.metadata.File != "" {
+			data[h.metadata.File] = h.filePath
+		}
+		if h.metadata.Offset != "" {
+			data[h.metadata.Offset] = start
+		}
+		if h.metadata.Timestamp != "" {
+			data[h.metadata.Timestamp] = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	if h.codec != nil {
+		h.codec.decode(line, data)
+	}
+
 	return data
 }
@@ -2,21 +2,85 @@ package butteredscones
 
 import (
 	"sync"
+	"time"
 )
 
 type FileReaderPool struct {
-	available map[string]*FileReader
-	locked    map[string]*FileReader
+	available map[FileID]*FileReader
+	locked    map[FileID]*FileReader
 	lock      sync.RWMutex
+
+	// The file group each reader was added for
+	groups map[FileID]string
+
+	// Readers are locked in turn. Groups with the highest priority go first.
+	// Groups with the same priority take turns in proportion to their weight,
+	// and within each group, files take turns.
+	groupRing []*poolGroup
+
+	// The pass of the group at each priority that was last given a turn.
+	// Groups that had nothing ready catch up to it, so they don't get a burst
+	// of turns once they do.
+	passes map[int]uint64
+
+	// Readers that should be locked next time, even if they aren't ready
+	woken map[FileID]bool
+
+	// Readers that may not be locked again until a time, because they've been
+	// sending too fast
+	throttled map[FileID]time.Time
+
+	// Signaled when a reader may have become ready to lock
+	notify chan interface{}
+
+	// Files waiting for a reader to be opened for them, because too many are
+	// open already. They're handed out first come, first served.
+	waiting      []*WaitingFile
+	waitingPaths map[string]bool
+}
+
+// poolGroup is a file group's readers, in the order they take turns.
+type poolGroup struct {
+	name    string
+	fileIDs []FileID
+	next    int
+
+	priority int
+	weight   int
+
+	// Grows by poolGroupStride / weight with each turn the group takes. The
+	// group with the lowest pass goes next.
+	pass uint64
+}
+
+const poolGroupStride = 1 << 20
+
+// WaitingFile is a file that needs to be read, but is waiting for a reader to
+// be opened for it.
+type WaitingFile struct {
+	Path   string
+	Config FileConfiguration
 }
 
 func NewFileReaderPool() *FileReaderPool {
 	return &FileReaderPool{
-		available: make(map[string]*FileReader),
-		locked:    make(map[string]*FileReader),
+		available:    make(map[FileID]*FileReader),
+		locked:       make(map[FileID]*FileReader),
+		groups:       make(map[FileID]string),
+		woken:        make(map[FileID]bool),
+		throttled:    make(map[FileID]time.Time),
+		passes:       make(map[int]uint64),
+		notify:       make(chan interface{}, 1),
+		waitingPaths: make(map[string]bool),
 	}
 }
 
+// Notify returns the channel readers in the pool should signal when they're
+// ready. See FileReaderOptions.Notify.
+func (p *FileReaderPool) Notify() chan<- interface{} {
+	return p.notify
+}
+
 func (p *FileReaderPool) Counts() (available int, locked int) {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
@@ -24,28 +88,122 @@ func (p *FileReaderPool) Counts() (available int, locked int) {
 	return len(p.available), len(p.locked)
 }
 
-// TODO: Figure out how to make this block, rather than return nil
-func (p *FileReaderPool) LockNext() *FileReader {
+// LockNext waits for an available reader to be ready (see FileReader.Ready),
+// locks it and returns it. It returns nil if stop is closed first. Readers
+// are only woken up by their Notify channel, so they should be created with
+// the pool's.
+func (p *FileReaderPool) LockNext(stop <-chan interface{}) *FileReader {
+	for {
+		if reader := p.TryLockNext(); reader != nil {
+			return reader
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-p.notify:
+			// something may be ready; look again
+		}
+	}
+}
+
+// TryLockNext locks and returns the next available reader that's ready, or
+// returns nil if none are. Readers in file groups with a higher priority are
+// locked first. Groups with the same priority take turns in proportion to
+// their weight, and the files in each group take turns, so a busy file can't
+// crowd out the rest.
+func (p *FileReaderPool) TryLockNext() *FileReader {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	for filePath, reader := range p.available {
-		delete(p.available, filePath)
-		p.locked[filePath] = reader
-		return reader
+	var best *poolGroup
+	bestIndex := -1
+	for _, group := range p.groupRing {
+		if pass := p.passes[group.priority]; group.pass < pass {
+			group.pass = pass
+		}
+
+		if best != nil && (group.priority < best.priority || (group.priority == best.priority && group.pass >= best.pass)) {
+			continue
+		}
+
+		if fileIndex := p.nextReady(group); fileIndex >= 0 {
+			best, bestIndex = group, fileIndex
+		}
+	}
+
+	if best == nil {
+		// Nothing available to lock
+		return nil
 	}
 
-	// Nothing available to lock
-	return nil
+	fileID := best.fileIDs[bestIndex]
+	reader := p.available[fileID]
+	delete(p.available, fileID)
+	delete(p.woken, fileID)
+	p.locked[fileID] = reader
+
+	best.next = (bestIndex + 1) % len(best.fileIDs)
+	p.passes[best.priority] = best.pass
+	best.pass += poolGroupStride / uint64(best.weight)
+
+	return reader
 }
 
-func (p *FileReaderPool) Unlock(reader *FileReader) {
+// nextReady returns the index of the next file in a group whose reader is
+// available and ready, or -1 if there isn't one. Assumes the lock is held by
+// the caller.
+func (p *FileReaderPool) nextReady(group *poolGroup) int {
+	now := time.Now()
+	for i := range group.fileIDs {
+		fileIndex := (group.next + i) % len(group.fileIDs)
+		fileID := group.fileIDs[fileIndex]
+
+		if until, ok := p.throttled[fileID]; ok {
+			if now.Before(until) && !p.woken[fileID] {
+				continue
+			}
+			delete(p.throttled, fileID)
+		}
+
+		if reader := p.available[fileID]; reader != nil && (reader.Ready() || p.woken[fileID]) {
+			return fileIndex
+		}
+	}
+
+	return -1
+}
+
+// Wake makes a reader be locked next time it's available, even if it isn't
+// ready, e.g. so it can be stopped.
+func (p *FileReaderPool) Wake(reader *FileReader) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
+	p.woken[reader.FileID()] = true
+	p.lock.Unlock()
 
-	filePath := reader.FilePath()
-	delete(p.locked, filePath)
-	p.available[filePath] = reader
+	p.signal()
+}
+
+// Throttle unlocks a reader, but keeps it from being locked again until d has
+// passed, unless it's woken.
+func (p *FileReaderPool) Throttle(reader *FileReader, d time.Duration) {
+	p.lock.Lock()
+	p.throttled[reader.FileID()] = time.Now().Add(d)
+	p.lock.Unlock()
+
+	p.Unlock(reader)
+	time.AfterFunc(d, p.signal)
+}
+
+func (p *FileReaderPool) signal() {
+	select {
+	case p.notify <- nil:
+	default:
+	}
+}
+
+func (p *FileReaderPool) Unlock(reader *FileReader) {
+	p.UnlockAll([]*FileReader{reader})
 }
 
 func (p *FileReaderPool) UnlockAll(readers []*FileReader) {
@@ -53,32 +211,179 @@ func (p *FileReaderPool) UnlockAll(readers []*FileReader) {
 	defer p.lock.Unlock()
 
 	for _, reader := range readers {
-		filePath := reader.FilePath()
-		delete(p.locked, filePath)
-		p.available[filePath] = reader
+		fileID := reader.FileID()
+		delete(p.locked, fileID)
+		p.available[fileID] = reader
 	}
+
+	// The readers may have gotten ready while they were locked
+	p.signal()
 }
 
-func (p *FileReaderPool) IsPathInPool(filePath string) bool {
+func (p *FileReaderPool) IsFileInPool(fileID FileID) bool {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
-	return (p.available[filePath] != nil || p.locked[filePath] != nil)
+	return (p.available[fileID] != nil || p.locked[fileID] != nil)
 }
 
 func (p *FileReaderPool) Add(reader *FileReader) {
+	p.AddToGroup(reader, FileConfiguration{})
+}
+
+// AddToGroup adds a reader for a file in a file group. It's counted against
+// the group in OpenCounts, and takes turns according to the group's priority
+// and weight.
+func (p *FileReaderPool) AddToGroup(reader *FileReader, config FileConfiguration) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	filePath := reader.FilePath()
-	p.available[filePath] = reader
+	fileID := reader.FileID()
+	p.available[fileID] = reader
+	if _, ok := p.groups[fileID]; !ok {
+		p.groups[fileID] = config.GroupName()
+		p.addToRing(fileID, config)
+	}
+
+	p.signal()
+}
+
+// OpenCounts returns the number of readers in the pool, and the number of them
+// in the named file group.
+func (p *FileReaderPool) OpenCounts(group string) (total int, inGroup int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for _, g := range p.groups {
+		if g == group {
+			inGroup++
+		}
+	}
+
+	return len(p.groups), inGroup
+}
+
+// Wait queues a file to have a reader opened for it once there's room. Files
+// that are already waiting keep their place in line.
+func (p *FileReaderPool) Wait(filePath string, config FileConfiguration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.waitingPaths[filePath] {
+		return
+	}
+	p.waitingPaths[filePath] = true
+	p.waiting = append(p.waiting, &WaitingFile{Path: filePath, Config: config})
+}
+
+// TakeWaiting removes every waiting file from the queue and returns them, in
+// the order they started waiting. Files that still have to wait should be
+// passed to Wait again, in the same order.
+func (p *FileReaderPool) TakeWaiting() []*WaitingFile {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	waiting := p.waiting
+	p.waiting = nil
+	p.waitingPaths = make(map[string]bool)
+
+	return waiting
+}
+
+// Waiting returns the files waiting for a reader, in the order they started
+// waiting, leaving them in the queue.
+func (p *FileReaderPool) Waiting() []*WaitingFile {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	waiting := make([]*WaitingFile, len(p.waiting))
+	copy(waiting, p.waiting)
+
+	return waiting
+}
+
+// WaitingCounts returns the number of files waiting for a reader, in total and
+// for each file group.
+func (p *FileReaderPool) WaitingCounts() (total int, byGroup map[string]int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	byGroup = make(map[string]int)
+	for _, waiting := range p.waiting {
+		byGroup[waiting.Config.GroupName()]++
+	}
+
+	return len(p.waiting), byGroup
 }
 
 func (p *FileReaderPool) Remove(reader *FileReader) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	filePath := reader.FilePath()
-	delete(p.available, filePath)
-	delete(p.locked, filePath)
+	fileID := reader.FileID()
+	delete(p.available, fileID)
+	delete(p.locked, fileID)
+	delete(p.woken, fileID)
+	delete(p.throttled, fileID)
+	if group, ok := p.groups[fileID]; ok {
+		delete(p.groups, fileID)
+		p.removeFromRing(fileID, group)
+	}
+}
+
+// addToRing gives a file a turn in its group, after the rest of the group's
+// files. Assumes the lock is held by the caller.
+func (p *FileReaderPool) addToRing(fileID FileID, config FileConfiguration) {
+	weight := config.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	name := config.GroupName()
+	for _, g := range p.groupRing {
+		if g.name == name {
+			g.fileIDs = append(g.fileIDs, fileID)
+			// The group may have been changed by a reload
+			g.priority, g.weight = config.Priority, weight
+			return
+		}
+	}
+
+	p.groupRing = append(p.groupRing, &poolGroup{
+		name:     name,
+		fileIDs:  []FileID{fileID},
+		priority: config.Priority,
+		weight:   weight,
+		pass:     p.passes[config.Priority],
+	})
+}
+
+// removeFromRing takes away a file's turn, and its group's if it was the
+// group's last file. Assumes the lock is held by the caller.
+func (p *FileReaderPool) removeFromRing(fileID FileID, group string) {
+	for groupIndex, g := range p.groupRing {
+		if g.name != group {
+			continue
+		}
+
+		for fileIndex, id := range g.fileIDs {
+			if id != fileID {
+				continue
+			}
+
+			g.fileIDs = append(g.fileIDs[:fileIndex], g.fileIDs[fileIndex+1:]...)
+			if fileIndex < g.next {
+				g.next--
+			}
+			if g.next >= len(g.fileIDs) {
+				g.next = 0
+			}
+			break
+		}
+
+		if len(g.fileIDs) == 0 {
+			p.groupRing = append(p.groupRing[:groupIndex], p.groupRing[groupIndex+1:]...)
+		}
+		return
+	}
 }
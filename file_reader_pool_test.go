@@ -22,7 +22,7 @@ func TestFileReaderPoolLockUnlock(t *testing.T) {
 	lockedReaders := make(chan *FileReader)
 	go func() {
 		for i := 0; i < 20; i++ {
-			if lockedReader := pool.LockNext(); lockedReader != nil {
+			if lockedReader := pool.TryLockNext(); lockedReader != nil {
 				lockedReaders <- lockedReader
 			}
 			<-time.After(10 * time.Millisecond)
@@ -35,7 +35,7 @@ func TestFileReaderPoolLockUnlock(t *testing.T) {
 			t.Fatalf("Expected reader %p but got %p", reader, lockedReader)
 		}
 		// Attempting to grab another reader should be nil
-		if anotherLockedReader := pool.LockNext(); anotherLockedReader != nil {
+		if anotherLockedReader := pool.TryLockNext(); anotherLockedReader != nil {
 			t.Fatalf("Expected to get nil when locking another reader, but got %#v", anotherLockedReader)
 		}
 		// Unlock the reader to make it available again
@@ -53,3 +53,191 @@ func TestFileReaderPoolLockUnlock(t *testing.T) {
 		t.Fatalf("Timed out")
 	}
 }
+
+func TestFileReaderPoolWaiting(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	pool := NewFileReaderPool()
+	reader, _ := NewFileReader(tmpFile, map[string]string{}, 128, 0)
+	pool.AddToGroup(reader, FileConfiguration{Name: "app"})
+
+	if total, inGroup := pool.OpenCounts("app"); total != 1 || inGroup != 1 {
+		t.Fatalf("Expected 1 open reader in group, but got %d total and %d in group", total, inGroup)
+	}
+	if total, inGroup := pool.OpenCounts("other"); total != 1 || inGroup != 0 {
+		t.Fatalf("Expected 1 open reader and none in group, but got %d total and %d in group", total, inGroup)
+	}
+
+	app := FileConfiguration{Name: "app"}
+	pool.Wait("/var/log/app1.log", app)
+	pool.Wait("/var/log/app2.log", app)
+	// Files that are already waiting keep their place
+	pool.Wait("/var/log/app1.log", app)
+
+	waiting, byGroup := pool.WaitingCounts()
+	if waiting != 2 || byGroup["app"] != 2 {
+		t.Fatalf("Expected 2 waiting files, but got %d (%v)", waiting, byGroup)
+	}
+
+	taken := pool.TakeWaiting()
+	if len(taken) != 2 || taken[0].Path != "/var/log/app1.log" || taken[1].Path != "/var/log/app2.log" {
+		t.Fatalf("Expected waiting files in order, but got %v", taken)
+	}
+	if waiting, _ := pool.WaitingCounts(); waiting != 0 {
+		t.Fatalf("Expected no waiting files, but got %d", waiting)
+	}
+
+	pool.Remove(reader)
+	if total, _ := pool.OpenCounts("app"); total != 0 {
+		t.Fatalf("Expected no open readers, but got %d", total)
+	}
+}
+
+func TestFileReaderPoolRoundRobin(t *testing.T) {
+	pool := NewFileReaderPool()
+
+	readers := make([]*FileReader, 0, 3)
+	for _, group := range []string{"a", "a", "b"} {
+		tmpFile, err := ioutil.TempFile("", "butteredscones")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+
+		if _, err = tmpFile.Write([]byte("line1\n")); err != nil {
+			t.Fatal(err)
+		}
+		tmpFile.Seek(0, os.SEEK_SET)
+
+		reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{ChunkSize: 128, Notify: pool.Notify()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool.AddToGroup(reader, FileConfiguration{Name: group})
+		readers = append(readers, reader)
+	}
+
+	for _, reader := range readers {
+		for !reader.Ready() {
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+
+	// Groups take turns, then files within each group do
+	expected := []*FileReader{readers[0], readers[2], readers[1], readers[2], readers[0]}
+	for i, reader := range expected {
+		if next := pool.TryLockNext(); next != reader {
+			t.Fatalf("Expected reader %d to be %p, but got %p", i, reader, next)
+		} else {
+			pool.Unlock(next)
+		}
+	}
+}
+
+func TestFileReaderPoolLockNextBlocks(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	pool := NewFileReaderPool()
+	stopRequest := make(chan interface{})
+
+	lockedReaders := make(chan *FileReader, 1)
+	go func() {
+		lockedReaders <- pool.LockNext(stopRequest)
+	}()
+
+	select {
+	case reader := <-lockedReaders:
+		t.Fatalf("Expected LockNext to block, but got %p", reader)
+	case <-time.After(50 * time.Millisecond):
+		// still waiting
+	}
+
+	reader, _ := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{ChunkSize: 128, Notify: pool.Notify()})
+	pool.Add(reader)
+
+	select {
+	case lockedReader := <-lockedReaders:
+		if lockedReader != reader {
+			t.Fatalf("Expected reader %p but got %p", reader, lockedReader)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout waiting for LockNext")
+	}
+
+	// Stopping wakes up LockNext
+	go func() {
+		lockedReaders <- pool.LockNext(stopRequest)
+	}()
+	close(stopRequest)
+
+	select {
+	case lockedReader := <-lockedReaders:
+		if lockedReader != nil {
+			t.Fatalf("Expected nil after stopping, but got %p", lockedReader)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout waiting for LockNext to stop")
+	}
+}
+
+func TestFileReaderPoolPriorityAndWeight(t *testing.T) {
+	pool := NewFileReaderPool()
+
+	groups := []FileConfiguration{
+		{Name: "audit", Priority: 10},
+		{Name: "app", Weight: 3},
+		{Name: "debug"},
+	}
+	readers := make([]*FileReader, 0, len(groups))
+	for _, config := range groups {
+		tmpFile, err := ioutil.TempFile("", "butteredscones")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+
+		reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{ChunkSize: 128, Notify: pool.Notify()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for !reader.Ready() {
+			<-time.After(10 * time.Millisecond)
+		}
+		pool.AddToGroup(reader, config)
+		readers = append(readers, reader)
+	}
+	audit, app, debug := readers[0], readers[1], readers[2]
+
+	// The group with the highest priority always goes first
+	for i := 0; i < 3; i++ {
+		if next := pool.TryLockNext(); next != audit {
+			t.Fatalf("Expected audit reader %p, but got %p", audit, next)
+		} else {
+			pool.Unlock(next)
+		}
+	}
+
+	// Once it's locked, the others share turns by weight
+	pool.TryLockNext()
+	counts := make(map[*FileReader]int)
+	for i := 0; i < 8; i++ {
+		next := pool.TryLockNext()
+		counts[next] += 1
+		pool.Unlock(next)
+	}
+	if counts[app] != 6 || counts[debug] != 2 {
+		t.Fatalf("Expected app to get 6 turns and debug 2, but got %d and %d", counts[app], counts[debug])
+	}
+}
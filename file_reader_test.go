@@ -208,3 +208,560 @@ func TestLineReaderLongLine(t *testing.T) {
 		t.Fatalf("Timeout")
 	}
 }
+
+func TestLineReaderTruncatedFile(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\nline3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReader(file, map[string]string{"type": "syslog"}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "line1" {
+			t.Fatalf("Expected \"line1\", got %q", chunk[0].Data["line"])
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	// While the reader is waiting to hand off line3, truncate the file in place
+	// and write a line shorter than what has already been read.
+	if _, err = tmpFile.WriteAt([]byte("new\n"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = tmpFile.Truncate(4); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"line2", "line3"} {
+		select {
+		case chunk := <-reader.C:
+			if chunk[0].Data["line"] != expected {
+				t.Fatalf("Expected %q, got %q", expected, chunk[0].Data["line"])
+			}
+		case <-time.After(250 * time.Millisecond):
+			t.Fatalf("Timeout")
+		}
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "new" {
+			t.Fatalf("Expected \"new\", got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 4 {
+			t.Fatalf("Expected HighWaterMark.Position=4, got %d", chunk[0].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderMultilinePrevious(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("Exception: boom\n  at foo\n  at bar\nline2\n  at baz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReaderWithOptions(file, &FileReaderOptions{
+		ChunkSize: 1,
+		Multiline: &MultilineConfiguration{
+			Pattern: `^\s`,
+			What:    "previous",
+			Timeout: Duration(200 * time.Millisecond),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "Exception: boom\n  at foo\n  at bar" {
+			t.Fatalf("Expected the stack trace to be joined, got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 34 {
+			t.Fatalf("Expected HighWaterMark.Position=34, got %d", chunk[0].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	// The rest of the event is written before the timeout
+	<-time.After(50 * time.Millisecond)
+	if _, err = tmpFile.Write([]byte("\n  at qux\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "line2\n  at baz\n  at qux" {
+			t.Fatalf("Expected the stack trace to be joined, got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 58 {
+			t.Fatalf("Expected HighWaterMark.Position=58, got %d", chunk[0].HighWaterMark.Position)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	select {
+	case _, ok := <-reader.C:
+		if ok {
+			t.Fatalf("Expected channel to be closed after EOF, but was not")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderMultilineStreamTimeout(t *testing.T) {
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeWriter.Close()
+
+	reader, err := NewFileReaderWithOptions(pipeReader, &FileReaderOptions{
+		ChunkSize: 1,
+		Multiline: &MultilineConfiguration{
+			Pattern: `^\s`,
+			What:    "previous",
+			Timeout: Duration(200 * time.Millisecond),
+		},
+		Stream: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Stop()
+
+	// Nothing more is written, but the pipe stays open
+	if _, err = pipeWriter.Write([]byte("Exception: boom\n  at foo\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "Exception: boom\n  at foo" {
+			t.Fatalf("Expected the stack trace to be joined, got %q", chunk[0].Data["line"])
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderMultilineNext(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("one \\\ntwo \\\nthree\nfour\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReaderWithOptions(file, &FileReaderOptions{
+		ChunkSize: 2,
+		Multiline: &MultilineConfiguration{
+			Pattern: `\\$`,
+			What:    "next",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if len(chunk) != 2 {
+			t.Fatalf("Expected 2 events, got %d", len(chunk))
+		}
+		if chunk[0].Data["line"] != "one \\\ntwo \\\nthree" {
+			t.Fatalf("Expected the lines to be joined, got %q", chunk[0].Data["line"])
+		}
+		if chunk[1].Data["line"] != "four" {
+			t.Fatalf("Expected \"four\", got %q", chunk[1].Data["line"])
+		}
+		if chunk[1].HighWaterMark.Position != 23 {
+			t.Fatalf("Expected HighWaterMark.Position=23, got %d", chunk[1].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderDelimiter(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// The last record is only partially written
+	_, err = tmpFile.Write([]byte("record\n1||record2||rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize: 2,
+		Framing:   &FramingConfiguration{Delimiter: "||"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if len(chunk) != 2 {
+			t.Fatalf("Expected 2 records, got %d", len(chunk))
+		}
+		if chunk[0].Data["line"] != "record\n1" {
+			t.Fatalf("Expected \"record\\n1\", got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 10 {
+			t.Fatalf("Expected HighWaterMark.Position=10, got %d", chunk[0].HighWaterMark.Position)
+		}
+		if chunk[1].Data["line"] != "record2" {
+			t.Fatalf("Expected \"record2\", got %q", chunk[1].Data["line"])
+		}
+		if chunk[1].HighWaterMark.Position != 19 {
+			t.Fatalf("Expected HighWaterMark.Position=19, got %d", chunk[1].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	select {
+	case _, ok := <-reader.C:
+		if ok {
+			t.Fatalf("Expected channel to be closed after EOF, but was not")
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderLengthPrefix(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// Two complete records, then a length prefix without its record
+	_, err = tmpFile.Write([]byte("\x00\x05line1\x00\x07line\n\x002\x00\x09"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize: 2,
+		Framing:   &FramingConfiguration{LengthPrefix: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if len(chunk) != 2 {
+			t.Fatalf("Expected 2 records, got %d", len(chunk))
+		}
+		if chunk[0].Data["line"] != "line1" {
+			t.Fatalf("Expected \"line1\", got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 7 {
+			t.Fatalf("Expected HighWaterMark.Position=7, got %d", chunk[0].HighWaterMark.Position)
+		}
+		if chunk[1].Data["line"] != "line\n\x002" {
+			t.Fatalf("Expected \"line\\n\\x002\", got %q", chunk[1].Data["line"])
+		}
+		if chunk[1].HighWaterMark.Position != 16 {
+			t.Fatalf("Expected HighWaterMark.Position=16, got %d", chunk[1].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	select {
+	case _, ok := <-reader.C:
+		if ok {
+			t.Fatalf("Expected channel to be closed after EOF, but was not")
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderEncoding(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	// UTF-16LE with a byte order mark and Windows line endings: "a\r\n" then
+	// "é\n"
+	_, err = tmpFile.Write([]byte("\xff\xfea\x00\r\x00\n\x00\xe9\x00\n\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize: 2,
+		Encoding:  "utf-16le",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if len(chunk) != 2 {
+			t.Fatalf("Expected 2 lines, got %d", len(chunk))
+		}
+		if chunk[0].Data["line"] != "a" {
+			t.Fatalf("Expected \"a\", got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 8 {
+			t.Fatalf("Expected HighWaterMark.Position=8, got %d", chunk[0].HighWaterMark.Position)
+		}
+		if chunk[1].Data["line"] != "é" {
+			t.Fatalf("Expected \"é\", got %q", chunk[1].Data["line"])
+		}
+		if chunk[1].HighWaterMark.Position != 12 {
+			t.Fatalf("Expected HighWaterMark.Position=12, got %d", chunk[1].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderLatin1(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("caf\xe9\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize: 1,
+		Encoding:  "latin1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "café" {
+			t.Fatalf("Expected \"café\", got %q", chunk[0].Data["line"])
+		}
+		if chunk[0].HighWaterMark.Position != 5 {
+			t.Fatalf("Expected HighWaterMark.Position=5, got %d", chunk[0].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderMetadata(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize: 2,
+		Metadata:  &MetadataConfiguration{File: "file", Offset: "offset", Timestamp: "read_at"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		for i, expectedOffset := range []int64{0, 6} {
+			data := chunk[i].Data
+			if data["file"] != tmpFile.Name() {
+				t.Fatalf("Expected [\"file\"]=%q, got %q", tmpFile.Name(), data["file"])
+			}
+			if data["offset"] != expectedOffset {
+				t.Fatalf("Expected [\"offset\"]=%d, got %v", expectedOffset, data["offset"])
+			}
+			if _, err := time.Parse(time.RFC3339, data["read_at"].(string)); err != nil {
+				t.Fatalf("Expected [\"read_at\"] to be an RFC 3339 timestamp, got %q", data["read_at"])
+			}
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderIncludeExcludeLines(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("GET /health\nGET /users\nDEBUG GET /users\nPOST /users\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Seek(0, os.SEEK_SET)
+
+	reader, err := NewFileReaderWithOptions(tmpFile, &FileReaderOptions{
+		ChunkSize:    4,
+		IncludeLines: []string{"GET"},
+		ExcludeLines: []string{"/health", "^DEBUG"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if len(chunk) != 4 {
+			t.Fatalf("Expected 4 lines, got %d", len(chunk))
+		}
+		for i, expected := range []interface{}{nil, "GET /users", nil, nil} {
+			var line interface{}
+			if chunk[i].Data != nil {
+				line = chunk[i].Data["line"]
+			}
+			if line != expected {
+				t.Fatalf("Expected line %d to be %v, got %v", i, expected, line)
+			}
+		}
+		// Filtered lines still move the high water mark forward
+		if chunk[3].HighWaterMark.Position != 52 {
+			t.Fatalf("Expected HighWaterMark.Position=52, got %d", chunk[3].HighWaterMark.Position)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+}
+
+func TestLineReaderCloseInactive(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewFileReaderWithOptions(file, &FileReaderOptions{
+		ChunkSize:     1,
+		CloseInactive: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case chunk := <-reader.C:
+		if chunk[0].Data["line"] != "line1" {
+			t.Fatalf("Expected \"line1\", got %q", chunk[0].Data["line"])
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	// Lines written after EOF are still read
+	_, err = tmpFile.Write([]byte("line2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case chunk := <-reader.C:
+		if chunk == nil {
+			t.Fatalf("Expected reader to still be open")
+		}
+		if chunk[0].Data["line"] != "line2" {
+			t.Fatalf("Expected \"line2\", got %q", chunk[0].Data["line"])
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("Timeout")
+	}
+
+	// Once nothing has been written for CloseInactive, the reader gives up
+	select {
+	case chunk := <-reader.C:
+		if chunk != nil {
+			t.Fatalf("Expected reader to be closed, got %v", chunk)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timeout")
+	}
+}
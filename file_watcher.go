@@ -0,0 +1,86 @@
+package butteredscones
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var errFileWatchingUnsupported = errors.New("file watching is not supported on this platform")
+
+// A fileWatcher watches directories for files being created or written to,
+// so they can be read right away rather than the next time paths are globbed.
+type fileWatcher interface {
+	// SetDirectories changes the directories being watched to dirs. If some
+	// can't be watched (e.g. because the limit on watches has been reached),
+	// the rest are still watched and an error is returned.
+	SetDirectories(dirs []string) error
+
+	// Events delivers an event for each file or directory created in, moved
+	// into, or written to in a watched directory. It is closed once the
+	// watcher is closed.
+	Events() <-chan fileWatchEvent
+
+	Close() error
+}
+
+type fileWatchEvent struct {
+	// The path of the file or directory. Empty if events were lost, in which
+	// case every watched directory should be looked at again.
+	Path string
+
+	// Set if the path is a directory.
+	Dir bool
+}
+
+// watchDirectories returns the directories that files matching patterns
+// could be created in. For patterns with "**" in them, that's every directory
+// under where "**" starts.
+func watchDirectories(patterns []string) []string {
+	seen := make(map[string]bool)
+	dirs := make([]string, 0, len(patterns))
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, pattern := range patterns {
+		if pattern == stdinPath {
+			continue
+		}
+
+		if hasRecursiveGlob(pattern) {
+			filepath.Walk(globRoot(pattern), func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					if info != nil && info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				if info.IsDir() {
+					add(path)
+				}
+				return nil
+			})
+			continue
+		}
+
+		dir := filepath.Dir(pattern)
+		if !hasGlobMeta(dir) {
+			add(dir)
+			continue
+		}
+
+		matches, _ := filepath.Glob(dir)
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.IsDir() {
+				add(match)
+			}
+		}
+	}
+
+	return dirs
+}
@@ -0,0 +1,151 @@
+package butteredscones
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyWatchMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MODIFY
+
+// inotifyWatcher watches directories with inotify.
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	events chan fileWatchEvent
+	done   chan interface{}
+
+	// Guards watches and dirs
+	lock sync.Mutex
+	// The watch descriptor of each watched directory, and the reverse
+	watches map[string]int32
+	dirs    map[int32]string
+}
+
+func newFileWatcher() (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		fd: fd,
+		// The descriptor is non-blocking, so reads go through the runtime's
+		// poller and Close interrupts them.
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		events:  make(chan fileWatchEvent, 64),
+		done:    make(chan interface{}),
+		watches: make(map[string]int32),
+		dirs:    make(map[int32]string),
+	}
+	go w.read()
+
+	return w, nil
+}
+
+func (w *inotifyWatcher) SetDirectories(dirs []string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	wanted := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		wanted[dir] = true
+	}
+
+	for dir, wd := range w.watches {
+		if !wanted[dir] {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, dir)
+			delete(w.dirs, wd)
+		}
+	}
+
+	for _, dir := range dirs {
+		if _, ok := w.watches[dir]; ok {
+			continue
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyWatchMask)
+		if err == syscall.ENOSPC {
+			// Out of watches; there's no use trying the rest
+			return os.NewSyscallError("inotify_add_watch", err)
+		} else if err != nil {
+			// The directory may not exist (yet), or may not be readable
+			continue
+		}
+		w.watches[dir] = int32(wd)
+		w.dirs[int32(wd)] = dir
+	}
+
+	return nil
+}
+
+func (w *inotifyWatcher) Events() <-chan fileWatchEvent {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+func (w *inotifyWatcher) read() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			offset = nameEnd
+			if nameEnd > n {
+				break
+			}
+
+			var event fileWatchEvent
+			var ok bool
+			switch {
+			case raw.Mask&syscall.IN_Q_OVERFLOW != 0:
+				event, ok = fileWatchEvent{}, true
+			case raw.Mask&syscall.IN_IGNORED != 0:
+				// The directory was removed, so its watch was too
+				w.lock.Lock()
+				if dir, found := w.dirs[raw.Wd]; found {
+					delete(w.watches, dir)
+					delete(w.dirs, raw.Wd)
+				}
+				w.lock.Unlock()
+			default:
+				w.lock.Lock()
+				dir, found := w.dirs[raw.Wd]
+				w.lock.Unlock()
+
+				name := string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00"))
+				if found && name != "" {
+					event = fileWatchEvent{
+						Path: filepath.Join(dir, name),
+						Dir:  raw.Mask&syscall.IN_ISDIR != 0,
+					}
+					ok = true
+				}
+			}
+
+			if ok {
+				select {
+				case w.events <- event:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
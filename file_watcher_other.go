@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package butteredscones
+
+func newFileWatcher() (fileWatcher, error) {
+	return nil, errFileWatchingUnsupported
+}
@@ -0,0 +1,203 @@
+package butteredscones
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	framingByteOrderBig    = "big"
+	framingByteOrderLittle = "little"
+
+	// Length-prefixed records longer than this are assumed to be corrupt,
+	// rather than buffered in memory.
+	framingMaxRecordLength = 64 * 1024 * 1024
+)
+
+// framing splits a file into records. By default, records are lines ending
+// in "\n".
+type framing interface {
+	// readRecord reads the rest of a record from r, appending it to partial
+	// (the start of the record, if some of it has already been read). If EOF
+	// is reached first, it returns what it has so far along with the error.
+	readRecord(r *bufio.Reader, partial []byte) ([]byte, error)
+
+	// isBuffered returns true if a complete record is in partial followed by
+	// buffered, so it can be read without waiting on the underlying file.
+	isBuffered(partial []byte, buffered []byte) bool
+
+	// content returns a complete record without its delimiter or length
+	// prefix, converted to UTF-8.
+	content(record []byte) []byte
+}
+
+// newFraming returns the framing for a file in the given character encoding,
+// which may be nil.
+func newFraming(config *FramingConfiguration, enc *characterEncoding) (framing, error) {
+	if config == nil {
+		config = &FramingConfiguration{}
+	}
+
+	if config.LengthPrefix > 0 {
+		if config.Delimiter != "" {
+			return nil, fmt.Errorf("framing can have a delimiter or a length_prefix, but not both")
+		}
+
+		framing := &lengthPrefixFraming{size: config.LengthPrefix, encoding: enc}
+		switch config.LengthPrefix {
+		case 1, 2, 4, 8:
+		default:
+			return nil, fmt.Errorf("framing length_prefix must be 1, 2, 4 or 8, got %d", config.LengthPrefix)
+		}
+		switch config.ByteOrder {
+		case "", framingByteOrderBig:
+			framing.byteOrder = binary.BigEndian
+		case framingByteOrderLittle:
+			framing.byteOrder = binary.LittleEndian
+		default:
+			return nil, fmt.Errorf("framing byte_order must be %q or %q, got %q", framingByteOrderBig, framingByteOrderLittle, config.ByteOrder)
+		}
+
+		return framing, nil
+	}
+
+	delimiter := config.Delimiter
+	if delimiter == "" {
+		delimiter = "\n"
+	}
+	encoded, err := enc.encode([]byte(delimiter))
+	if err != nil {
+		return nil, err
+	}
+
+	return &delimiterFraming{
+		delimiter: encoded,
+		alignment: enc.alignment(),
+		encoding:  enc,
+		trimCR:    delimiter == "\n",
+	}, nil
+}
+
+// delimiterFraming splits records on a sequence of one or more bytes.
+type delimiterFraming struct {
+	delimiter []byte
+
+	// Records are a multiple of this many bytes long, so the delimiter only
+	// matches on a character boundary in encodings like UTF-16
+	alignment int
+
+	encoding *characterEncoding
+
+	// Lines ending in "\r\n" have the "\r" removed too
+	trimCR bool
+}
+
+func (f *delimiterFraming) readRecord(r *bufio.Reader, partial []byte) ([]byte, error) {
+	last := f.delimiter[len(f.delimiter)-1]
+	for {
+		chunk, err := r.ReadBytes(last)
+		partial = append(partial, chunk...)
+		if err != nil {
+			return partial, err
+		}
+		if bytes.HasSuffix(partial, f.delimiter) && len(partial)%f.alignment == 0 {
+			return partial, nil
+		}
+	}
+}
+
+func (f *delimiterFraming) isBuffered(partial []byte, buffered []byte) bool {
+	if len(f.delimiter) == 1 {
+		return bytes.IndexByte(buffered, f.delimiter[0]) >= 0
+	}
+
+	// The delimiter may straddle what's already been read and what's buffered
+	overlap := len(f.delimiter) - 1
+	if overlap > len(partial) {
+		overlap = len(partial)
+	}
+	data := make([]byte, 0, overlap+len(buffered))
+	data = append(data, partial[len(partial)-overlap:]...)
+	data = append(data, buffered...)
+
+	return bytes.Index(data, f.delimiter) >= 0
+}
+
+func (f *delimiterFraming) content(record []byte) []byte {
+	content := f.encoding.decode(bytes.TrimSuffix(record, f.delimiter))
+	if f.trimCR {
+		content = bytes.TrimRight(content, "\r")
+	}
+	return content
+}
+
+// lengthPrefixFraming reads records that are each preceded by their length,
+// as an unsigned integer.
+type lengthPrefixFraming struct {
+	size      int
+	byteOrder binary.ByteOrder
+	encoding  *characterEncoding
+}
+
+func (f *lengthPrefixFraming) readRecord(r *bufio.Reader, partial []byte) ([]byte, error) {
+	for {
+		length, err := f.recordLength(partial)
+		if err != nil {
+			return partial, err
+		}
+		if len(partial) >= length {
+			return partial, nil
+		}
+
+		rest := make([]byte, length-len(partial))
+		n, err := io.ReadFull(r, rest)
+		partial = append(partial, rest[:n]...)
+		if err == io.ErrUnexpectedEOF {
+			return partial, io.EOF
+		} else if err != nil {
+			return partial, err
+		}
+	}
+}
+
+func (f *lengthPrefixFraming) isBuffered(partial []byte, buffered []byte) bool {
+	data := make([]byte, 0, len(partial)+len(buffered))
+	data = append(data, partial...)
+	data = append(data, buffered...)
+
+	length, err := f.recordLength(data)
+	return err == nil && len(data) >= length
+}
+
+func (f *lengthPrefixFraming) content(record []byte) []byte {
+	return f.encoding.decode(record[f.size:])
+}
+
+// recordLength returns the length of the record at the start of data,
+// including its prefix, or just the length of the prefix if data doesn't
+// include all of it yet.
+func (f *lengthPrefixFraming) recordLength(data []byte) (int, error) {
+	if len(data) < f.size {
+		return f.size, nil
+	}
+
+	var length uint64
+	switch f.size {
+	case 1:
+		length = uint64(data[0])
+	case 2:
+		length = uint64(f.byteOrder.Uint16(data))
+	case 4:
+		length = uint64(f.byteOrder.Uint32(data))
+	case 8:
+		length = f.byteOrder.Uint64(data)
+	}
+
+	if length > framingMaxRecordLength {
+		return 0, fmt.Errorf("record length %d is longer than %d bytes", length, framingMaxRecordLength)
+	}
+	return f.size + int(length), nil
+}
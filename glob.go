@@ -0,0 +1,157 @@
+package butteredscones
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A path segment of "**" in a glob pattern matches any number of directories,
+// including none.
+const globRecursive = "**"
+
+// globFiles returns the paths matching pattern, like filepath.Glob, except
+// that "**" matches any number of nested directories. Paths that match any of
+// excludes are left out.
+func globFiles(pattern string, excludes []string) ([]string, error) {
+	var matches []string
+	var err error
+	if hasRecursiveGlob(pattern) {
+		matches, err = globRecursively(pattern)
+	} else {
+		matches, err = filepath.Glob(pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(excludes) == 0 {
+		return matches, nil
+	}
+
+	included := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if !matchesAnyPath(excludes, match) {
+			included = append(included, match)
+		}
+	}
+
+	return included, nil
+}
+
+// globRecursively walks the directory at the start of pattern that has no
+// wildcards in it, returning the files under it that match pattern.
+func globRecursively(pattern string) ([]string, error) {
+	patternSegments := splitPath(filepath.Clean(pattern))
+
+	// Validate the pattern up front, since walking may not come across a path
+	// that exercises all of it
+	for _, segment := range patternSegments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	matches := make([]string, 0)
+	err := filepath.Walk(globRoot(pattern), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories that can't be read are skipped, like filepath.Glob does
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.IsDir() && matchSegments(patternSegments, splitPath(path)) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return matches, nil
+	}
+
+	return matches, err
+}
+
+// globRoot returns the directory at the start of pattern that has no
+// wildcards in it.
+func globRoot(pattern string) string {
+	patternSegments := splitPath(filepath.Clean(pattern))
+
+	rootSegments := patternSegments
+	for i, segment := range patternSegments {
+		if hasGlobMeta(segment) {
+			rootSegments = patternSegments[:i]
+			break
+		}
+	}
+
+	root := strings.Join(rootSegments, string(filepath.Separator))
+	if root == "" {
+		if filepath.IsAbs(pattern) {
+			return string(filepath.Separator)
+		}
+		return "."
+	}
+
+	return root
+}
+
+// matchesAnyPath returns true if path matches any of patterns. Patterns
+// without a path separator in them are matched against the base name of path
+// (e.g. "*.gz"); others are matched against the whole path, and may use "**".
+func matchesAnyPath(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchPath(pattern, path string) bool {
+	if !strings.ContainsRune(pattern, filepath.Separator) {
+		matched, _ := filepath.Match(pattern, filepath.Base(path))
+		return matched
+	}
+
+	return matchSegments(splitPath(filepath.Clean(pattern)), splitPath(filepath.Clean(path)))
+}
+
+// matchSegments matches the segments of a path against the segments of a
+// pattern, where a "**" segment matches any number of path segments.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == globRecursive {
+		return matchSegments(pattern[1:], path) || (len(path) > 0 && matchSegments(pattern, path[1:]))
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+	matched, _ := filepath.Match(pattern[0], path[0])
+	return matched && matchSegments(pattern[1:], path[1:])
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, string(filepath.Separator))
+}
+
+func hasRecursiveGlob(pattern string) bool {
+	for _, segment := range splitPath(pattern) {
+		if segment == globRecursive {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasGlobMeta(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
@@ -0,0 +1,72 @@
+package butteredscones
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGlobFilesRecursive(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, path := range []string{
+		"app1/logs/app.log",
+		"app1/logs/app-debug.log",
+		"app1/logs/app.log.gz",
+		"app2/nested/logs/app.log",
+		"app2/other/app.log",
+		"logs/top.log",
+	} {
+		path = filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("line1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, err := globFiles(filepath.Join(tmpDir, "**/logs/*.log"), []string{"*-debug.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		filepath.Join(tmpDir, "app1/logs/app.log"),
+		filepath.Join(tmpDir, "app2/nested/logs/app.log"),
+		filepath.Join(tmpDir, "logs/top.log"),
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("expected %v, but got %v", expected, matches)
+	}
+
+	// Excludes can match whole paths, too
+	matches, err = globFiles(filepath.Join(tmpDir, "app*/**/*.log"), []string{filepath.Join(tmpDir, "app2/**")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{
+		filepath.Join(tmpDir, "app1/logs/app-debug.log"),
+		filepath.Join(tmpDir, "app1/logs/app.log"),
+	}
+	if !reflect.DeepEqual(matches, expected) {
+		t.Fatalf("expected %v, but got %v", expected, matches)
+	}
+}
+
+func TestGlobFilesMissingDirectory(t *testing.T) {
+	matches, err := globFiles("/does/not/exist/**/*.log", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Fatalf("expected no matches, but got %v", matches)
+	}
+}
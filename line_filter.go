@@ -0,0 +1,68 @@
+package butteredscones
+
+import (
+	"regexp"
+)
+
+// lineFilter decides which lines of a file are sent, by matching them against
+// regular expressions.
+type lineFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newLineFilter returns a filter that only lets through lines matching one of
+// include (if any are given) and none of exclude. It returns nil if neither
+// are given, which lets through every line.
+func newLineFilter(include, exclude []string) (*lineFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	f := &lineFilter{}
+	var err error
+	if f.include, err = compilePatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = compilePatterns(exclude); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+
+	return compiled, nil
+}
+
+// Allow returns true if line should be sent.
+func (f *lineFilter) Allow(line []byte) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.include) > 0 && !matchesAny(f.include, line) {
+		return false
+	}
+
+	return !matchesAny(f.exclude, line)
+}
+
+func matchesAny(patterns []*regexp.Regexp, line []byte) bool {
+	for _, re := range patterns {
+		if re.Match(line) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,27 +5,77 @@ import (
 	"compress/zlib"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/digitalocean/butteredscones/client"
 	"github.com/technoweenie/grohl"
 )
 
+var errDisconnected = errors.New("disconnected")
+
 type Client struct {
 	options *ClientOptions
 
-	conn     net.Conn
-	sequence uint32
+	// Held while connecting and writing windows, so windows are written to the
+	// connection one at a time, in order
+	lock sync.Mutex
+	conn *connection
 }
 
+const (
+	// Version 1 of the protocol, spoken by logstash-forwarder and the lumberjack
+	// input of logstash. Every value is sent as a string.
+	ProtocolVersion1 = 1
+
+	// Version 2 of the protocol, spoken by beats and the beats input of
+	// logstash. Events are sent as JSON, so values may be nested or typed.
+	ProtocolVersion2 = 2
+)
+
 type ClientOptions struct {
 	Network           string
 	Address           string
 	ConnectionTimeout time.Duration
 	SendTimeout       time.Duration
 	TLSConfig         *tls.Config
+
+	// ProtocolVersion is either ProtocolVersion1 or ProtocolVersion2. Defaults
+	// to ProtocolVersion1.
+	ProtocolVersion int
+
+	// MaxWindowsInFlight is how many windows may be sent before the first of
+	// them is acknowledged. Sending more than one at a time avoids waiting a
+	// round trip between windows. Defaults to 1.
+	MaxWindowsInFlight int
+}
+
+// connection is a single connection to the remote server, and the windows
+// that have been sent over it but not acknowledged yet. Sequence numbers start
+// over with each connection.
+type connection struct {
+	net.Conn
+	sequence uint32
+
+	// Guards pending and err, and is signalled whenever either changes
+	lock    sync.Mutex
+	cond    *sync.Cond
+	pending []*pendingWindow
+	err     error
+}
+
+type pendingWindow struct {
+	*client.Window
+
+	firstSequence uint32
+	lastSequence  uint32
+	acked         int
 }
 
 func NewClient(options *ClientOptions) *Client {
@@ -35,6 +85,10 @@ func NewClient(options *ClientOptions) *Client {
 }
 
 func (c *Client) ensureConnected() error {
+	if c.conn != nil && c.conn.Err() != nil {
+		c.conn = nil
+	}
+
 	if c.conn == nil {
 		logger := grohl.NewContext(grohl.Data{"ns": "lumberjack.Client", "fn": "ensureConnected", "addr": c.options.Address})
 		timer := logger.Timer(grohl.Data{})
@@ -65,97 +119,322 @@ func (c *Client) ensureConnected() error {
 		}
 
 		timer.Finish()
-		c.conn = conn
+		c.conn = newConnection(conn)
+		go c.conn.readAcks(c.version(), c.options.SendTimeout)
 	}
 
 	return nil
 }
 
 func (c *Client) Disconnect() error {
-	var err error
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.conn != nil {
-		err = c.conn.Close()
+		c.conn.fail(errDisconnected)
 		c.conn = nil
 	}
 
-	c.sequence = 0
-	return err
+	return nil
 }
 
 func (c *Client) Name() string {
 	return c.options.Address
 }
 
-func (c *Client) Send(lines []client.Data) error {
+// Send sends lines as a single window and waits for the remote server to
+// acknowledge them. It returns the number of lines, from the beginning of
+// lines, that were acknowledged. If that is fewer than all of them, err
+// explains why.
+func (c *Client) Send(lines []client.Data) (int, error) {
+	window, err := c.SendWindow(lines)
+	if err != nil {
+		return 0, err
+	}
+
+	<-window.Done()
+	return window.Result()
+}
+
+// SendWindow sends lines as a single window, without waiting for the remote
+// server to acknowledge them. If MaxWindowsInFlight windows are already
+// waiting to be acknowledged, it blocks until one is.
+func (c *Client) SendWindow(lines []client.Data) (*client.Window, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	err := c.ensureConnected()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	conn := c.conn
+
+	// Sequence numbers of the first and last line in this window
+	firstSequence := conn.sequence + 1
 
 	// Serialize (w/ compression)
-	linesBuf := c.serialize(lines)
+	linesBuf, err := c.serialize(conn, lines)
+	if err != nil {
+		return nil, err
+	}
 	linesBytes := linesBuf.Bytes()
 
+	window := &pendingWindow{
+		Window:        client.NewWindow(),
+		firstSequence: firstSequence,
+		lastSequence:  conn.sequence,
+	}
+
+	version := c.version()
 	headerBuf := new(bytes.Buffer)
 
 	// Window size
-	headerBuf.WriteString("1W")
+	headerBuf.WriteString(version + "W")
 	binary.Write(headerBuf, binary.BigEndian, uint32(len(lines)))
 
 	// Compressed size
-	headerBuf.WriteString("1C")
+	headerBuf.WriteString(version + "C")
 	binary.Write(headerBuf, binary.BigEndian, uint32(len(linesBytes)))
 
+	// Wait for room for another window in flight. From here on, a failure is
+	// reported through the window rather than returned.
+	if err := conn.push(window, c.maxWindowsInFlight()); err != nil {
+		return nil, err
+	}
+
 	// Write header to socket
-	c.conn.SetDeadline(time.Now().Add(c.options.SendTimeout))
-	_, err = c.conn.Write(headerBuf.Bytes())
+	conn.SetWriteDeadline(time.Now().Add(c.options.SendTimeout))
+	_, err = conn.Write(headerBuf.Bytes())
 	if err != nil {
-		c.Disconnect()
-		return err
+		conn.fail(err)
+		return window.Window, nil
 	}
 
 	// Write compressed lines to socket
-	_, err = c.conn.Write(linesBytes)
+	_, err = conn.Write(linesBytes)
 	if err != nil {
-		c.Disconnect()
-		return err
+		conn.fail(err)
+		return window.Window, nil
 	}
 
-	// Wait for ACK (6 bytes)
-	// This is pretty weird, but is mirroring what logstash-forwarder does
-	ack := make([]byte, 6)
-	ackBytes := 0
-	for ackBytes < 6 {
-		n, err := c.conn.Read(ack[ackBytes:len(ack)])
-		if n > 0 {
-			ackBytes += n
-		} else if err != nil {
-			c.Disconnect()
-			return err
-		}
+	return window.Window, nil
+}
+
+func (c *Client) maxWindowsInFlight() int {
+	if c.options.MaxWindowsInFlight > 0 {
+		return c.options.MaxWindowsInFlight
 	}
+	return 1
+}
+
+func newConnection(conn net.Conn) *connection {
+	c := &connection{Conn: conn}
+	c.cond = sync.NewCond(&c.lock)
 
+	return c
+}
+
+// Err returns the error that caused the connection to fail, or nil if it is
+// still usable.
+func (c *connection) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.err
+}
+
+// push adds a window to the end of the windows in flight, waiting until there
+// are fewer than max of them.
+func (c *connection) push(window *pendingWindow, max int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.pending) >= max && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return c.err
+	}
+
+	c.pending = append(c.pending, window)
+	c.cond.Broadcast()
 	return nil
 }
 
-func (c *Client) serialize(lines []client.Data) *bytes.Buffer {
+// fail closes the connection, failing every window still in flight.
+func (c *connection) fail(err error) {
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return
+	}
+	c.err = err
+	windows := c.pending
+	c.pending = nil
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	c.Close()
+	for _, window := range windows {
+		window.Finish(window.acked, err)
+	}
+}
+
+// readAcks reads ACKs from the connection, finishing windows in the order they
+// were sent as the last line in each of them is acknowledged. The server may
+// acknowledge part of a window first, either because it is slow to process it
+// or as a keepalive.
+func (c *connection) readAcks(version string, timeout time.Duration) {
+	for {
+		c.lock.Lock()
+		for len(c.pending) == 0 && c.err == nil {
+			c.cond.Wait()
+		}
+		if c.err != nil {
+			c.lock.Unlock()
+			return
+		}
+		c.lock.Unlock()
+
+		// Each ACK, even a partial one, gives the server more time to finish
+		c.SetReadDeadline(time.Now().Add(timeout))
+		sequence, err := c.readAck(version)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.acknowledge(sequence)
+	}
+}
+
+// acknowledge records an ACK of every line up to and including sequence,
+// finishing any windows that are now completely acknowledged.
+func (c *connection) acknowledge(sequence uint32) {
+	c.lock.Lock()
+	finished := make([]*pendingWindow, 0, 1)
+	for len(c.pending) > 0 {
+		window := c.pending[0]
+		if sequence >= window.firstSequence && sequence <= window.lastSequence {
+			window.acked = int(sequence-window.firstSequence) + 1
+		}
+		if sequence < window.lastSequence {
+			break
+		}
+
+		finished = append(finished, window)
+		c.pending = c.pending[1:]
+	}
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	for _, window := range finished {
+		window.Finish(int(window.lastSequence-window.firstSequence)+1, nil)
+	}
+}
+
+// readAck reads an ACK frame, returning the sequence number it acknowledges.
+func (c *connection) readAck(version string) (uint32, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return 0, err
+	}
+	if string(header) != version+"A" {
+		return 0, fmt.Errorf("expected %sA, got %q", version, header)
+	}
+
+	var sequence uint32
+	if err := binary.Read(c, binary.BigEndian, &sequence); err != nil {
+		return 0, err
+	}
+
+	return sequence, nil
+}
+
+func (c *Client) version() string {
+	if c.options.ProtocolVersion == ProtocolVersion2 {
+		return "2"
+	}
+	return "1"
+}
+
+func (c *Client) serialize(conn *connection, lines []client.Data) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 	compressor := zlib.NewWriter(buf)
 
+	sequence := conn.sequence
 	for _, data := range lines {
-		c.sequence += 1
-
-		compressor.Write([]byte("1D"))
-		binary.Write(compressor, binary.BigEndian, uint32(c.sequence))
-		binary.Write(compressor, binary.BigEndian, uint32(len(data)))
-		for k, v := range data {
-			binary.Write(compressor, binary.BigEndian, uint32(len(k)))
-			compressor.Write([]byte(k))
-			binary.Write(compressor, binary.BigEndian, uint32(len(v)))
-			compressor.Write([]byte(v))
+		conn.sequence += 1
+
+		var err error
+		if c.options.ProtocolVersion == ProtocolVersion2 {
+			err = writeJSONFrame(compressor, conn.sequence, data)
+		} else {
+			err = writeDataFrame(compressor, conn.sequence, data)
+		}
+		if err != nil {
+			compressor.Close()
+			conn.sequence = sequence
+			return nil, err
 		}
 	}
 
 	compressor.Close()
-	return buf
+	return buf, nil
+}
+
+// writeDataFrame writes a version 1 data frame, in which every key and value
+// is a string.
+func writeDataFrame(w *zlib.Writer, sequence uint32, data client.Data) error {
+	w.Write([]byte("1D"))
+	binary.Write(w, binary.BigEndian, sequence)
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	for k, v := range data {
+		value, err := stringValue(v)
+		if err != nil {
+			return err
+		}
+
+		binary.Write(w, binary.BigEndian, uint32(len(k)))
+		w.Write([]byte(k))
+		binary.Write(w, binary.BigEndian, uint32(len(value)))
+		w.Write([]byte(value))
+	}
+
+	return nil
+}
+
+// writeJSONFrame writes a version 2 JSON frame.
+func writeJSONFrame(w *zlib.Writer, sequence uint32, data client.Data) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	w.Write([]byte("2J"))
+	binary.Write(w, binary.BigEndian, sequence)
+	binary.Write(w, binary.BigEndian, uint32(len(payload)))
+	w.Write(payload)
+
+	return nil
+}
+
+// stringValue converts a value to the string sent for it in a version 1 data
+// frame. Strings, and values that encode to JSON strings (like time.Time), are
+// sent as-is; anything else is sent encoded as JSON.
+func stringValue(v interface{}) (string, error) {
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	var str string
+	if json.Unmarshal(encoded, &str) == nil {
+		return str, nil
+	}
+	return string(encoded), nil
 }
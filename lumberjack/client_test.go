@@ -34,7 +34,7 @@ func TestClientSmokeTest(t *testing.T) {
 	lines := []client.Data{
 		client.Data{"line": "foo bar baz", "offset": "25"},
 	}
-	err = c.Send(lines)
+	_, err = c.Send(lines)
 	if err != nil {
 		t.Error(err)
 	}
@@ -75,7 +75,7 @@ func TestClientReconnectSmokeTest(t *testing.T) {
 	lines := []client.Data{
 		client.Data{"line": "foo bar baz", "offset": "25"},
 	}
-	err = c.Send(lines)
+	_, err = c.Send(lines)
 	if err == nil {
 		t.Fatalf("Expected Send to timeout, but did not")
 	}
@@ -84,7 +84,7 @@ func TestClientReconnectSmokeTest(t *testing.T) {
 	dataCh := make(chan client.Data, 1)
 	go server.ServeInto(dataCh)
 
-	err = c.Send(lines)
+	_, err = c.Send(lines)
 	if err != nil {
 		t.Error(err)
 	}
@@ -96,3 +96,233 @@ func TestClientReconnectSmokeTest(t *testing.T) {
 		t.Fatal("Timeout waiting for lines to arrive")
 	}
 }
+
+func TestClientProtocolVersion2(t *testing.T) {
+	server, err := newLumberjackServer(&serverOptions{
+		Network: "tcp",
+		Address: "127.0.0.1:0", // random port
+
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataCh := make(chan client.Data, 1)
+	go server.ServeInto(dataCh)
+
+	c := NewClient(&ClientOptions{
+		Network:           "tcp",
+		Address:           server.Addr().String(),
+		ConnectionTimeout: 2 * time.Second,
+		SendTimeout:       2 * time.Second,
+		ProtocolVersion:   ProtocolVersion2,
+	})
+
+	lines := []client.Data{
+		client.Data{"line": "foo bar baz", "offset": 25, "tags": map[string]interface{}{"env": "production"}},
+	}
+	_, err = c.Send(lines)
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case receivedLine := <-dataCh:
+		if receivedLine["line"] != lines[0]["line"] {
+			t.Fatalf("Got line of %s, expected %s", receivedLine["line"], lines[0]["line"])
+		}
+		if receivedLine["offset"] != float64(25) {
+			t.Fatalf("Got offset of %#v, expected %#v", receivedLine["offset"], 25)
+		}
+		if tags, ok := receivedLine["tags"].(map[string]interface{}); !ok || tags["env"] != "production" {
+			t.Fatalf("Got tags of %#v, expected nested map", receivedLine["tags"])
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("Timeout waiting for lines to arrive")
+	}
+}
+
+func TestClientProtocolVersion1StringifiesValues(t *testing.T) {
+	server, err := newLumberjackServer(&serverOptions{
+		Network: "tcp",
+		Address: "127.0.0.1:0", // random port
+
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataCh := make(chan client.Data, 1)
+	go server.ServeInto(dataCh)
+
+	c := NewClient(&ClientOptions{
+		Network:           "tcp",
+		Address:           server.Addr().String(),
+		ConnectionTimeout: 2 * time.Second,
+		SendTimeout:       2 * time.Second,
+	})
+
+	lines := []client.Data{
+		client.Data{"line": "foo bar baz", "offset": 25, "tags": []string{"a", "b"}},
+	}
+	_, err = c.Send(lines)
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case receivedLine := <-dataCh:
+		if receivedLine["offset"] != "25" {
+			t.Fatalf("Got offset of %#v, expected %#v", receivedLine["offset"], "25")
+		}
+		if receivedLine["tags"] != `["a","b"]` {
+			t.Fatalf("Got tags of %#v, expected %#v", receivedLine["tags"], `["a","b"]`)
+		}
+	case <-time.After(250 * time.Millisecond):
+		t.Fatal("Timeout waiting for lines to arrive")
+	}
+}
+
+func TestClientPartialAcknowledgement(t *testing.T) {
+	server, err := newLumberjackServer(&serverOptions{
+		Network: "tcp",
+		Address: "127.0.0.1:0", // random port
+
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		AckLimit:     2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataCh := make(chan client.Data, 3)
+	go server.ServeInto(dataCh)
+
+	c := NewClient(&ClientOptions{
+		Network:           "tcp",
+		Address:           server.Addr().String(),
+		ConnectionTimeout: 2 * time.Second,
+		SendTimeout:       2 * time.Second,
+	})
+
+	lines := []client.Data{
+		client.Data{"line": "line1"},
+		client.Data{"line": "line2"},
+		client.Data{"line": "line3"},
+	}
+	acked, err := c.Send(lines)
+	if err == nil {
+		t.Fatalf("Expected an error for a partial acknowledgement, but got none")
+	}
+	if acked != 2 {
+		t.Fatalf("Expected 2 lines to be acknowledged, but got %d", acked)
+	}
+
+	// The rest is sent over a new connection
+	acked, err = c.Send(lines[acked:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acked != 1 {
+		t.Fatalf("Expected 1 line to be acknowledged, but got %d", acked)
+	}
+}
+
+func TestClientMultipleWindows(t *testing.T) {
+	server, err := newLumberjackServer(&serverOptions{
+		Network: "tcp",
+		Address: "127.0.0.1:0", // random port
+
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataCh := make(chan client.Data, 2)
+	go server.ServeInto(dataCh)
+
+	c := NewClient(&ClientOptions{
+		Network:           "tcp",
+		Address:           server.Addr().String(),
+		ConnectionTimeout: 2 * time.Second,
+		SendTimeout:       2 * time.Second,
+	})
+
+	// Sequence numbers continue across windows on the same connection, and
+	// each window must be acknowledged by its own last sequence number
+	for i := 0; i < 2; i++ {
+		acked, err := c.Send([]client.Data{client.Data{"line": "foo bar baz"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acked != 1 {
+			t.Fatalf("Expected 1 line to be acknowledged, but got %d", acked)
+		}
+	}
+}
+
+func TestClientPipelinedWindows(t *testing.T) {
+	server, err := newLumberjackServer(&serverOptions{
+		Network: "tcp",
+		Address: "127.0.0.1:0", // random port
+
+		WriteTimeout: 2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dataCh := make(chan client.Data, 3)
+	go server.ServeInto(dataCh)
+
+	c := NewClient(&ClientOptions{
+		Network:            "tcp",
+		Address:            server.Addr().String(),
+		ConnectionTimeout:  2 * time.Second,
+		SendTimeout:        2 * time.Second,
+		MaxWindowsInFlight: 3,
+	})
+
+	// All three windows are sent before any of them are acknowledged
+	windows := make([]*client.Window, 0, 3)
+	for i := 0; i < 3; i++ {
+		window, err := c.SendWindow([]client.Data{client.Data{"line": "foo bar baz"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		windows = append(windows, window)
+	}
+
+	for _, window := range windows {
+		select {
+		case <-window.Done():
+			acked, err := window.Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acked != 1 {
+				t.Fatalf("Expected 1 line to be acknowledged, but got %d", acked)
+			}
+		case <-time.After(250 * time.Millisecond):
+			t.Fatal("Timeout waiting for window to be acknowledged")
+		}
+	}
+}
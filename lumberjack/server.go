@@ -5,7 +5,9 @@ import (
 	"compress/zlib"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
@@ -26,6 +28,10 @@ type serverOptions struct {
 
 	WriteTimeout time.Duration
 	ReadTimeout  time.Duration
+
+	// If set, at most this many lines in each window are acknowledged before
+	// the connection is closed. Useful for testing partial acknowledgements.
+	AckLimit int
 }
 
 func newLumberjackServer(options *serverOptions) (*Server, error) {
@@ -71,17 +77,32 @@ func (s *Server) ServeInto(dataCh chan<- client.Data) error {
 
 func (s *Server) serveClient(conn net.Conn, dataCh chan<- client.Data) error {
 	defer conn.Close()
+
+	for {
+		if err := s.serveWindow(conn, dataCh); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// serveWindow reads a single window of lines from a connection and
+// acknowledges it.
+func (s *Server) serveWindow(conn net.Conn, dataCh chan<- client.Data) error {
 	controlBuf := make([]byte, 8) // up to 8 bytes (uint32 size) for storing control bytes
 
 	conn.SetReadDeadline(time.Now().Add(s.options.ReadTimeout))
 
-	// Window size
+	// Window size; its version determines the version of the frames that follow
 	var windowSize uint32
-	if _, err := conn.Read(controlBuf[0:2]); err != nil {
+	if _, err := io.ReadFull(conn, controlBuf[0:2]); err != nil {
 		return err
 	}
-	if bytes.Compare(controlBuf[0:2], []byte("1W")) != 0 {
-		return fmt.Errorf("Expected 1W, got %v", controlBuf[0:2])
+	version := controlBuf[0]
+	if (version != '1' && version != '2') || controlBuf[1] != 'W' {
+		return fmt.Errorf("Expected 1W or 2W, got %v", controlBuf[0:2])
 	}
 	if err := binary.Read(conn, binary.BigEndian, &windowSize); err != nil {
 		return err
@@ -89,11 +110,11 @@ func (s *Server) serveClient(conn net.Conn, dataCh chan<- client.Data) error {
 
 	// Compressed size
 	var compressedSize uint32
-	if _, err := conn.Read(controlBuf[0:2]); err != nil {
+	if _, err := io.ReadFull(conn, controlBuf[0:2]); err != nil {
 		return err
 	}
-	if bytes.Compare(controlBuf[0:2], []byte("1C")) != 0 {
-		return fmt.Errorf("Expected 1C, got %v", controlBuf[0:2])
+	if controlBuf[0] != version || controlBuf[1] != 'C' {
+		return fmt.Errorf("Expected %cC, got %v", version, controlBuf[0:2])
 	}
 	if err := binary.Read(conn, binary.BigEndian, &compressedSize); err != nil {
 		return err
@@ -102,7 +123,7 @@ func (s *Server) serveClient(conn net.Conn, dataCh chan<- client.Data) error {
 	// Compressed payload
 	// TODO: It is possible to rework this without allocating a huge buffer upfront
 	compressedBuf := make([]byte, int(compressedSize))
-	if _, err := conn.Read(compressedBuf); err != nil {
+	if _, err := io.ReadFull(conn, compressedBuf); err != nil {
 		return err
 	}
 	uncompressor, err := zlib.NewReader(bytes.NewBuffer(compressedBuf))
@@ -111,14 +132,12 @@ func (s *Server) serveClient(conn net.Conn, dataCh chan<- client.Data) error {
 	}
 	defer uncompressor.Close()
 
+	var lastSequence uint32
 	lines := make([]client.Data, 0, int(windowSize))
 	for i := 0; i < int(windowSize); i++ {
-		if _, err := uncompressor.Read(controlBuf[0:2]); err != nil {
+		if _, err := io.ReadFull(uncompressor, controlBuf[0:2]); err != nil {
 			return err
 		}
-		if bytes.Compare(controlBuf[0:2], []byte("1D")) != 0 {
-			return fmt.Errorf("Expected 1D, got %v", controlBuf[0:2])
-		}
 
 		// Sequence
 		var sequence uint32
@@ -126,47 +145,101 @@ func (s *Server) serveClient(conn net.Conn, dataCh chan<- client.Data) error {
 			return err
 		}
 
-		// Payload key length
-		var dataLength uint32
-		if err = binary.Read(uncompressor, binary.BigEndian, &dataLength); err != nil {
-			return err
+		var data client.Data
+		switch {
+		case bytes.Equal(controlBuf[0:2], []byte("1D")):
+			data, err = readDataFrame(uncompressor)
+		case bytes.Equal(controlBuf[0:2], []byte("2J")):
+			data, err = readJSONFrame(uncompressor)
+		default:
+			err = fmt.Errorf("Expected 1D or 2J, got %v", controlBuf[0:2])
 		}
-
-		data := make(client.Data, int(dataLength))
-		for j := 0; j < int(dataLength); j++ {
-			var length uint32
-
-			if err = binary.Read(uncompressor, binary.BigEndian, &length); err != nil {
-				return err
-			}
-			k := make([]byte, int(length))
-			if _, err = uncompressor.Read(k); err != nil {
-				return err
-			}
-
-			if err = binary.Read(uncompressor, binary.BigEndian, &length); err != nil {
-				return err
-			}
-			v := make([]byte, int(length))
-			if _, err = uncompressor.Read(v); err != nil {
-				return err
-			}
-
-			data[string(k)] = string(v)
+		if err != nil {
+			return err
 		}
 
 		lines = append(lines, data)
+		lastSequence = sequence
+	}
+
+	limited := s.options.AckLimit > 0 && len(lines) > s.options.AckLimit
+	if limited {
+		lastSequence -= uint32(len(lines) - s.options.AckLimit)
+		lines = lines[:s.options.AckLimit]
 	}
 
 	conn.SetWriteDeadline(time.Now().Add(s.options.WriteTimeout))
-	conn.Write([]byte("ackack")) // TODO: What exactly is ack supposed to be here?
+	conn.Write([]byte{version, 'A'})
+	binary.Write(conn, binary.BigEndian, lastSequence)
 
 	for _, data := range lines {
 		dataCh <- data
 	}
+
+	if limited {
+		// Closing the connection leaves the rest of the window unacknowledged
+		return io.EOF
+	}
 	return nil
 }
 
+// readDataFrame reads a version 1 data frame, after its "1D" header and
+// sequence number.
+func readDataFrame(r io.Reader) (client.Data, error) {
+	// Payload key length
+	var dataLength uint32
+	if err := binary.Read(r, binary.BigEndian, &dataLength); err != nil {
+		return nil, err
+	}
+
+	data := make(client.Data, int(dataLength))
+	for j := 0; j < int(dataLength); j++ {
+		k, err := readLengthPrefixed(r)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := readLengthPrefixed(r)
+		if err != nil {
+			return nil, err
+		}
+
+		data[string(k)] = string(v)
+	}
+
+	return data, nil
+}
+
+// readJSONFrame reads a version 2 JSON frame, after its "2J" header and
+// sequence number.
+func readJSONFrame(r io.Reader) (client.Data, error) {
+	payload, err := readLengthPrefixed(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var data client.Data
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, int(length))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
 func (s *Server) Close() error {
 	return s.listener.Close()
 }
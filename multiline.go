@@ -0,0 +1,133 @@
+package butteredscones
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	multilineWhatPrevious = "previous"
+	multilineWhatNext     = "next"
+
+	defaultMultilineMaxLines = 500
+	defaultMultilineTimeout  = 5 * time.Second
+)
+
+// multiline assembles lines into events according to a
+// MultilineConfiguration, e.g. so that each line of a stack trace isn't sent
+// as a separate event.
+type multiline struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	next     bool
+	maxLines int
+	timeout  time.Duration
+
+	// Lines of the event currently being assembled
+	lines [][]byte
+	// The position in the file of the first line in lines
+	start int64
+	// The position in the file after the last line in lines
+	position int64
+	// When the last line was added to lines
+	lastLine time.Time
+}
+
+// multilineEvent is a complete event, made up of one or more lines.
+type multilineEvent struct {
+	Line []byte
+
+	// The position in the file of the first line of the event
+	Start int64
+
+	// The position in the file after the last line of the event
+	Position int64
+}
+
+func newMultiline(config *MultilineConfiguration) (*multiline, error) {
+	pattern, err := regexp.Compile(config.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &multiline{
+		pattern:  pattern,
+		negate:   config.Negate,
+		maxLines: config.MaxLines,
+		timeout:  time.Duration(config.Timeout),
+	}
+
+	switch config.What {
+	case "", multilineWhatPrevious:
+		m.next = false
+	case multilineWhatNext:
+		m.next = true
+	default:
+		return nil, fmt.Errorf("multiline what must be %q or %q, got %q", multilineWhatPrevious, multilineWhatNext, config.What)
+	}
+
+	if m.maxLines <= 0 {
+		m.maxLines = defaultMultilineMaxLines
+	}
+	if m.timeout <= 0 {
+		m.timeout = defaultMultilineTimeout
+	}
+
+	return m, nil
+}
+
+// Add adds a line (without its line ending) that starts at start and ends at
+// position in the file. It returns any events that are complete as a result.
+func (m *multiline) Add(line []byte, start, position int64) []*multilineEvent {
+	events := make([]*multilineEvent, 0, 2)
+
+	matches := m.pattern.Match(line) != m.negate
+	if !m.next && !matches && len(m.lines) > 0 {
+		// The line starts a new event, so the previous one is complete
+		events = append(events, m.Flush())
+	}
+
+	if len(m.lines) == 0 {
+		m.start = start
+	}
+	m.lines = append(m.lines, line)
+	m.position = position
+	m.lastLine = time.Now()
+
+	if (m.next && !matches) || len(m.lines) >= m.maxLines {
+		events = append(events, m.Flush())
+	}
+
+	return events
+}
+
+// Pending returns true if lines have been added that aren't part of a
+// complete event yet.
+func (m *multiline) Pending() bool {
+	return len(m.lines) > 0
+}
+
+// Expired returns true if it has been longer than the configured timeout
+// since the last line was added, meaning the pending event should be flushed
+// as-is.
+func (m *multiline) Expired() bool {
+	return time.Since(m.lastLine) >= m.timeout
+}
+
+// Flush returns the pending lines as an event, whether or not it is complete.
+func (m *multiline) Flush() *multilineEvent {
+	if len(m.lines) == 0 {
+		return nil
+	}
+
+	event := &multilineEvent{
+		Line:     bytes.Join(m.lines, []byte("\n")),
+		Start:    m.start,
+		Position: m.position,
+	}
+	m.lines = nil
+
+	return event
+}
@@ -0,0 +1,309 @@
+package butteredscones
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Each chunk is sent to whichever server is ready for it first. This is the
+	// default.
+	NetworkModeLoadBalance = "loadbalance"
+
+	// Chunks are sent to the first server. If it fails, they're sent to the next
+	// server instead, until the first server has had time to recover.
+	NetworkModeFailover = "failover"
+
+	// Each chunk is sent to every server, and progress is only saved once all of
+	// them have acknowledged it.
+	NetworkModeBroadcast = "broadcast"
+)
+
+const (
+	// How long a server that failed in failover mode is passed over before it
+	// is tried again. Repeated failures back off exponentially.
+	failoverMinimumRecovery = 5 * time.Second
+	failoverMaximumRecovery = 5 * time.Minute
+)
+
+func validNetworkMode(mode string) error {
+	switch mode {
+	case NetworkModeLoadBalance, NetworkModeFailover, NetworkModeBroadcast:
+		return nil
+	}
+
+	return fmt.Errorf("network mode must be %q, %q or %q, got %q", NetworkModeLoadBalance, NetworkModeFailover, NetworkModeBroadcast, mode)
+}
+
+// chunkQueue holds chunks waiting to be sent. Retries are kept separate to
+// avoid deadlocking when multiple clients need to retry.
+type chunkQueue struct {
+	ready chan *readyChunk
+	retry *retryQueue
+}
+
+func newChunkQueue(readySize int) *chunkQueue {
+	return &chunkQueue{
+		ready: make(chan *readyChunk, readySize),
+		retry: newRetryQueue(),
+	}
+}
+
+// retryQueue holds chunks that failed to be sent. Putting a chunk back never
+// blocks, however many clients are failing at once, so the goroutines doing
+// it can't end up waiting on each other.
+type retryQueue struct {
+	lock   sync.Mutex
+	chunks []*readyChunk
+
+	// Signalled when there may be chunks to take
+	ready chan interface{}
+}
+
+func newRetryQueue() *retryQueue {
+	return &retryQueue{ready: make(chan interface{}, 1)}
+}
+
+// Push adds a chunk to the end of the queue.
+func (q *retryQueue) Push(chunk *readyChunk) {
+	q.lock.Lock()
+	q.chunks = append(q.chunks, chunk)
+	q.lock.Unlock()
+
+	q.signal()
+}
+
+// Pop takes the chunk at the front of the queue, or returns nil if it's
+// empty.
+func (q *retryQueue) Pop() *readyChunk {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.chunks) == 0 {
+		return nil
+	}
+
+	chunk := q.chunks[0]
+	q.chunks[0] = nil
+	q.chunks = q.chunks[1:]
+	if len(q.chunks) > 0 {
+		// Let another client take the next one
+		q.signal()
+	}
+
+	return chunk
+}
+
+// Ready returns a channel that receives when there may be chunks to Pop.
+func (q *retryQueue) Ready() <-chan interface{} {
+	return q.ready
+}
+
+func (q *retryQueue) signal() {
+	select {
+	case q.ready <- nil:
+	default:
+	}
+}
+
+// broadcastChunk is a chunk that has been handed to every client in broadcast
+// mode. Each client gets its own copy of the chunk to track its own progress.
+type broadcastChunk struct {
+	chunk     *readyChunk
+	remaining int32
+}
+
+// Acknowledge records that one more client has sent the whole chunk. It
+// returns true once every client has.
+func (b *broadcastChunk) Acknowledge() bool {
+	return atomic.AddInt32(&b.remaining, -1) == 0
+}
+
+// failover tracks which client is active in failover mode. The active client
+// is the first one, in configured order, that hasn't failed recently.
+type failover struct {
+	lock    sync.Mutex
+	clients []*failoverClient
+	active  int
+
+	// Closed and replaced whenever the active client changes
+	changed chan struct{}
+}
+
+type failoverClient struct {
+	name           string
+	backoff        *ExponentialBackoff
+	unhealthyUntil time.Time
+}
+
+func newFailover(names []string) *failover {
+	f := &failover{
+		clients: make([]*failoverClient, 0, len(names)),
+		changed: make(chan struct{}),
+	}
+	for _, name := range names {
+		f.clients = append(f.clients, newFailoverClient(name))
+	}
+	if len(names) > 0 {
+		GlobalStatistics.SetActiveClient(names[0])
+	}
+
+	return f
+}
+
+func newFailoverClient(name string) *failoverClient {
+	return &failoverClient{
+		name:    name,
+		backoff: &ExponentialBackoff{Minimum: failoverMinimumRecovery, Maximum: failoverMaximumRecovery},
+	}
+}
+
+// SetClients replaces the clients to fail over between, e.g. after the
+// configuration is reloaded. Clients that were already known keep their
+// health.
+func (f *failover) SetClients(names []string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var activeName string
+	if f.active < len(f.clients) {
+		activeName = f.clients[f.active].name
+	}
+
+	clients := make([]*failoverClient, 0, len(names))
+	for _, name := range names {
+		if index := f.index(name); index >= 0 {
+			clients = append(clients, f.clients[index])
+		} else {
+			clients = append(clients, newFailoverClient(name))
+		}
+	}
+	f.clients = clients
+
+	// Wake everything waiting, so clients that were removed stop waiting
+	f.active = f.index(activeName)
+	if f.active < 0 {
+		f.active = 0
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.elect(time.Now())
+}
+
+// WaitUntilActive blocks until the named client is the active one. It returns
+// false if stopRequest is closed first, or if the client is no longer one of
+// the clients to fail over between.
+func (f *failover) WaitUntilActive(name string, stopRequest <-chan interface{}) bool {
+	for {
+		f.lock.Lock()
+		now := time.Now()
+		f.elect(now)
+		index := f.index(name)
+		active, changed := f.active, f.changed
+		recovery := f.nextRecovery(now)
+		f.lock.Unlock()
+
+		if index < 0 {
+			return false
+		} else if active == index {
+			return true
+		}
+
+		// A client that failed may become active again once it has recovered,
+		// even if nothing else changes in the meantime.
+		var recovered <-chan time.Time
+		if recovery > 0 {
+			recovered = time.After(recovery)
+		}
+
+		select {
+		case <-stopRequest:
+			return false
+		case <-changed:
+		case <-recovered:
+		}
+	}
+}
+
+// Failed marks the named client as unhealthy, failing over to the next client
+// if it was the active one.
+func (f *failover) Failed(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	index := f.index(name)
+	if index < 0 {
+		return
+	}
+
+	client := f.clients[index]
+	now := time.Now()
+	client.unhealthyUntil = now.Add(client.backoff.Next())
+	f.elect(now)
+}
+
+// Succeeded marks the named client as healthy.
+func (f *failover) Succeeded(name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if index := f.index(name); index >= 0 {
+		f.clients[index].backoff.Reset()
+	}
+}
+
+// index returns the position of the named client, or -1 if there isn't one.
+// The caller must hold lock.
+func (f *failover) index(name string) int {
+	for i, client := range f.clients {
+		if client.name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// elect picks the active client: the first healthy one, or if none of them
+// are healthy, the one that will recover soonest. The caller must hold lock.
+func (f *failover) elect(now time.Time) {
+	elected := -1
+	for i, client := range f.clients {
+		if !client.unhealthyUntil.After(now) {
+			elected = i
+			break
+		}
+		if elected < 0 || client.unhealthyUntil.Before(f.clients[elected].unhealthyUntil) {
+			elected = i
+		}
+	}
+
+	if elected >= 0 && elected != f.active {
+		f.active = elected
+		close(f.changed)
+		f.changed = make(chan struct{})
+
+		GlobalStatistics.SetActiveClient(f.clients[elected].name)
+		GlobalStatistics.IncrementFailovers()
+	}
+}
+
+// nextRecovery returns how long until the next unhealthy client that is
+// preferred over the active one recovers, or 0 if there isn't one. The caller
+// must hold lock.
+func (f *failover) nextRecovery(now time.Time) time.Duration {
+	var next time.Duration
+	if f.active >= len(f.clients) {
+		return 0
+	}
+
+	for _, client := range f.clients[:f.active] {
+		if wait := client.unhealthyUntil.Sub(now); wait > 0 && (next == 0 || wait < next) {
+			next = wait
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,82 @@
+package butteredscones
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailoverElectsFirstHealthyClient(t *testing.T) {
+	f := newFailover([]string{"primary", "standby1", "standby2"})
+	stopRequest := make(chan interface{})
+
+	if !f.WaitUntilActive("primary", stopRequest) {
+		t.Fatalf("expected primary to be active")
+	}
+
+	f.Failed("primary")
+	if f.active != 1 {
+		t.Fatalf("expected standby1 to be active after primary failed, but got %d", f.active)
+	}
+
+	f.Failed("standby1")
+	if f.active != 2 {
+		t.Fatalf("expected standby2 to be active after standby1 failed, but got %d", f.active)
+	}
+
+	// Once the primary recovers, it's preferred again
+	f.clients[0].unhealthyUntil = time.Now().Add(50 * time.Millisecond)
+	select {
+	case <-waitUntilActive(f, "primary", stopRequest):
+		// success
+	case <-time.After(250 * time.Millisecond):
+		t.Fatalf("timeout waiting for primary to become active again")
+	}
+}
+
+func TestFailoverAllClientsUnhealthy(t *testing.T) {
+	f := newFailover([]string{"primary", "standby"})
+
+	f.Failed("primary")
+	f.Failed("standby")
+
+	// The client that recovers soonest is active
+	if f.active != 0 {
+		t.Fatalf("expected primary to be active, but got %d", f.active)
+	}
+}
+
+func waitUntilActive(f *failover, name string, stopRequest chan interface{}) <-chan bool {
+	active := make(chan bool, 1)
+	go func() {
+		active <- f.WaitUntilActive(name, stopRequest)
+	}()
+
+	return active
+}
+
+func TestRetryQueueNeverFills(t *testing.T) {
+	q := newRetryQueue()
+
+	// Far more than any client has in flight
+	chunks := make([]*readyChunk, supervisorMaxWindowsInFlight*10)
+	for i := range chunks {
+		chunks[i] = &readyChunk{}
+		q.Push(chunks[i])
+	}
+
+	for i := range chunks {
+		select {
+		case <-q.Ready():
+		case <-time.After(250 * time.Millisecond):
+			t.Fatalf("timeout waiting for chunk %d to be ready", i)
+		}
+
+		if chunk := q.Pop(); chunk != chunks[i] {
+			t.Fatalf("expected chunk %d, but got %#v", i, chunk)
+		}
+	}
+
+	if chunk := q.Pop(); chunk != nil {
+		t.Fatalf("expected queue to be empty, but got %#v", chunk)
+	}
+}
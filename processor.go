@@ -0,0 +1,166 @@
+package butteredscones
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/digitalocean/butteredscones/client"
+)
+
+// A Processor transforms events after they're read from a file and before
+// they're sent. Process may change data in place or return different data.
+// It returns nil to drop the event, in which case it isn't sent, but
+// progress through the file still moves past it.
+type Processor interface {
+	Process(data client.Data) client.Data
+}
+
+// AddFieldsProcessor sets fields on each event, replacing any that are
+// already there.
+type AddFieldsProcessor map[string]string
+
+func (p AddFieldsProcessor) Process(data client.Data) client.Data {
+	for k, v := range p {
+		data[k] = v
+	}
+
+	return data
+}
+
+// RenameFieldsProcessor renames fields on each event, from each key to its
+// value. Fields that aren't there are left alone.
+type RenameFieldsProcessor map[string]string
+
+func (p RenameFieldsProcessor) Process(data client.Data) client.Data {
+	for from, to := range p {
+		if v, ok := data[from]; ok {
+			delete(data, from)
+			data[to] = v
+		}
+	}
+
+	return data
+}
+
+// RemoveFieldsProcessor removes fields from each event.
+type RemoveFieldsProcessor []string
+
+func (p RemoveFieldsProcessor) Process(data client.Data) client.Data {
+	for _, k := range p {
+		delete(data, k)
+	}
+
+	return data
+}
+
+// DropEventsProcessor drops events with a field that matches a regular
+// expression. Fields that are missing or aren't strings never match.
+type DropEventsProcessor map[string]*regexp.Regexp
+
+func (p DropEventsProcessor) Process(data client.Data) client.Data {
+	for field, pattern := range p {
+		if v, ok := data[field].(string); ok && pattern.MatchString(v) {
+			return nil
+		}
+	}
+
+	return data
+}
+
+// NewDropEventsProcessor builds a DropEventsProcessor from a pattern for each
+// field.
+func NewDropEventsProcessor(patterns map[string]string) (DropEventsProcessor, error) {
+	p := make(DropEventsProcessor, len(patterns))
+	for field, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid drop_events pattern for %q: %s", field, err)
+		}
+		p[field] = re
+	}
+
+	return p, nil
+}
+
+// NewProcessors builds the processors described by a file group's
+// configuration, in order.
+func NewProcessors(configs []ProcessorConfiguration) ([]Processor, error) {
+	processors := make([]Processor, 0, len(configs))
+	for _, config := range configs {
+		processor, err := NewProcessor(config)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, processor)
+	}
+
+	return processors, nil
+}
+
+// NewProcessor builds the processor described by config, which must have
+// exactly one of its options set.
+func NewProcessor(config ProcessorConfiguration) (Processor, error) {
+	var processors []Processor
+	if config.AddFields != nil {
+		processors = append(processors, AddFieldsProcessor(config.AddFields))
+	}
+	if config.RenameFields != nil {
+		processors = append(processors, RenameFieldsProcessor(config.RenameFields))
+	}
+	if config.RemoveFields != nil {
+		processors = append(processors, RemoveFieldsProcessor(config.RemoveFields))
+	}
+	if config.DropEvents != nil {
+		processor, err := NewDropEventsProcessor(config.DropEvents)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, processor)
+	}
+
+	if len(processors) != 1 {
+		return nil, fmt.Errorf("processor must have exactly one of add_fields, rename_fields, remove_fields or drop_events")
+	}
+
+	return processors[0], nil
+}
+
+// processChunk runs processors over a chunk read from a file, returning the
+// events that are left and how many the processors dropped. Events without
+// data, which were filtered out by the reader, are removed too. The high
+// water mark of the chunk's last event is moved to the last event that's
+// left, so progress moves past the removed events once it's acknowledged. If
+// every event is removed, the returned chunk is empty.
+func processChunk(processors []Processor, chunk []*FileData) ([]*FileData, int) {
+	if len(chunk) == 0 {
+		return chunk, 0
+	}
+	highWaterMark := chunk[len(chunk)-1].HighWaterMark
+
+	processed := make([]*FileData, 0, len(chunk))
+	dropped := 0
+	for _, fileData := range chunk {
+		data := fileData.Data
+		if data == nil {
+			continue
+		}
+
+		for _, processor := range processors {
+			if data = processor.Process(data); data == nil {
+				break
+			}
+		}
+
+		if data != nil {
+			processed = append(processed, &FileData{Data: data, HighWaterMark: fileData.HighWaterMark, Length: fileData.Length})
+		} else {
+			dropped++
+		}
+	}
+
+	if len(processed) > 0 {
+		processed[len(processed)-1].HighWaterMark = highWaterMark
+	}
+
+	return processed, dropped
+}
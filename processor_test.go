@@ -0,0 +1,85 @@
+package butteredscones
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/digitalocean/butteredscones/client"
+)
+
+func TestProcessors(t *testing.T) {
+	processors, err := NewProcessors([]ProcessorConfiguration{
+		{AddFields: map[string]string{"env": "production"}},
+		{RenameFields: map[string]string{"line": "message"}},
+		{RemoveFields: []string{"host"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := []*FileData{
+		{Data: client.Data{"line": "hello", "host": "web1"}},
+	}
+	processed, _ := processChunk(processors, chunk)
+
+	expected := client.Data{"message": "hello", "env": "production"}
+	if !reflect.DeepEqual(processed[0].Data, expected) {
+		t.Fatalf("expected %v, but got %v", expected, processed[0].Data)
+	}
+}
+
+func TestProcessorsInvalid(t *testing.T) {
+	_, err := NewProcessors([]ProcessorConfiguration{
+		{AddFields: map[string]string{"env": "production"}, RemoveFields: []string{"host"}},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for a processor with two options")
+	}
+
+	_, err = NewProcessors([]ProcessorConfiguration{{}})
+	if err == nil {
+		t.Fatalf("expected an error for a processor with no options")
+	}
+
+	_, err = NewProcessors([]ProcessorConfiguration{
+		{DropEvents: map[string]string{"line": "("}},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for an invalid drop_events pattern")
+	}
+}
+
+func TestProcessChunkDropped(t *testing.T) {
+	processors, err := NewProcessors([]ProcessorConfiguration{
+		{DropEvents: map[string]string{"line": "^drop$"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := []*FileData{
+		{Data: client.Data{"line": "keep"}, HighWaterMark: &HighWaterMark{Position: 5}},
+		{Data: client.Data{"line": "drop"}, HighWaterMark: &HighWaterMark{Position: 10}},
+		{Data: client.Data{"line": "keep"}, HighWaterMark: &HighWaterMark{Position: 15}},
+		{Data: client.Data{"line": "drop"}, HighWaterMark: &HighWaterMark{Position: 20}},
+	}
+	processed, dropped := processChunk(processors, chunk)
+
+	if len(processed) != 2 || dropped != 2 {
+		t.Fatalf("expected 2 events and 2 dropped, but got %d and %d", len(processed), dropped)
+	}
+	if processed[0].HighWaterMark.Position != 5 {
+		t.Fatalf("expected first event's position to be 5, but got %d", processed[0].HighWaterMark.Position)
+	}
+	// The last event carries the position past the dropped event after it
+	if processed[1].HighWaterMark.Position != 20 {
+		t.Fatalf("expected last event's position to be 20, but got %d", processed[1].HighWaterMark.Position)
+	}
+
+	chunk = []*FileData{
+		{Data: client.Data{"line": "drop"}, HighWaterMark: &HighWaterMark{Position: 5}},
+	}
+	if processed, _ := processChunk(processors, chunk); len(processed) != 0 {
+		t.Fatalf("expected every event to be dropped, but got %d", len(processed))
+	}
+}
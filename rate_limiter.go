@@ -0,0 +1,140 @@
+package butteredscones
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how many events, and how many bytes of them, are let
+// through each second, with a token bucket for each. Up to a second's worth
+// can be let through at once. Past that, the buckets go into debt, and
+// callers wait for them to be paid back, so any amount can be let through
+// without starving.
+//
+// A nil *RateLimiter lets everything through.
+type RateLimiter struct {
+	limit RateLimitConfiguration
+
+	lock   sync.Mutex
+	events *tokenBucket
+	bytes  *tokenBucket
+
+	// For testing
+	now func() time.Time
+}
+
+// NewRateLimiter returns a rate limiter for a limit, or nil if the limit
+// doesn't limit anything.
+func NewRateLimiter(limit RateLimitConfiguration) *RateLimiter {
+	if limit.EventsPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &RateLimiter{
+		limit:  limit,
+		events: newTokenBucket(limit.EventsPerSecond),
+		bytes:  newTokenBucket(limit.BytesPerSecond),
+		now:    time.Now,
+	}
+}
+
+// Limit returns the limit the rate limiter was created with.
+func (r *RateLimiter) Limit() RateLimitConfiguration {
+	if r == nil {
+		return RateLimitConfiguration{}
+	}
+
+	return r.limit
+}
+
+// Delay returns how long it will be until the rate limiter lets anything else
+// through.
+func (r *RateLimiter) Delay() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	r.events.refill(now)
+	r.bytes.refill(now)
+
+	return maxDuration(r.events.delay(), r.bytes.delay())
+}
+
+// Take lets events through, even if it puts the rate limiter in debt, and
+// returns how long it will be until it lets anything else through.
+func (r *RateLimiter) Take(events int, bytes int64) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	r.events.refill(now)
+	r.bytes.refill(now)
+	r.events.take(float64(events))
+	r.bytes.take(float64(bytes))
+
+	return maxDuration(r.events.delay(), r.bytes.delay())
+}
+
+// tokenBucket holds up to a second's worth of tokens. A nil *tokenBucket is
+// never empty.
+type tokenBucket struct {
+	// Tokens added each second
+	rate float64
+
+	// Negative if more has been taken than there was
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &tokenBucket{rate: rate, tokens: rate}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b == nil {
+		return
+	}
+
+	if !b.updated.IsZero() && now.After(b.updated) {
+		b.tokens += now.Sub(b.updated).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.updated = now
+}
+
+func (b *tokenBucket) take(tokens float64) {
+	if b != nil {
+		b.tokens -= tokens
+	}
+}
+
+// delay returns how long until the bucket is out of debt.
+func (b *tokenBucket) delay() time.Duration {
+	if b == nil || b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,53 @@
+package butteredscones
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	limiter := NewRateLimiter(RateLimitConfiguration{EventsPerSecond: 10, BytesPerSecond: 1000})
+	limiter.now = func() time.Time { return now }
+
+	// A second's worth goes through right away
+	if wait := limiter.Take(10, 500); wait != 0 {
+		t.Fatalf("Expected no wait, but got %s", wait)
+	}
+
+	// Past that, the wait is for whichever limit is furthest behind
+	if wait := limiter.Take(5, 1000); wait != 500*time.Millisecond {
+		t.Fatalf("Expected to wait %s, but got %s", 500*time.Millisecond, wait)
+	}
+	if delay := limiter.Delay(); delay != 500*time.Millisecond {
+		t.Fatalf("Expected a delay of %s, but got %s", 500*time.Millisecond, delay)
+	}
+
+	now = now.Add(250 * time.Millisecond)
+	if delay := limiter.Delay(); delay != 250*time.Millisecond {
+		t.Fatalf("Expected a delay of %s, but got %s", 250*time.Millisecond, delay)
+	}
+
+	// No more than a second's worth is saved up
+	now = now.Add(time.Minute)
+	if wait := limiter.Take(10, 0); wait != 0 {
+		t.Fatalf("Expected no wait, but got %s", wait)
+	}
+	if wait := limiter.Take(1, 0); wait != 100*time.Millisecond {
+		t.Fatalf("Expected to wait %s, but got %s", 100*time.Millisecond, wait)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfiguration{})
+	if limiter != nil {
+		t.Fatalf("Expected no rate limiter without limits, but got %#v", limiter)
+	}
+
+	if wait := limiter.Take(1000000, 1000000); wait != 0 {
+		t.Fatalf("Expected no wait, but got %s", wait)
+	}
+	if delay := limiter.Delay(); delay != 0 {
+		t.Fatalf("Expected no delay, but got %s", delay)
+	}
+}
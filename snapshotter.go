@@ -1,6 +1,15 @@
 package butteredscones
 
+import (
+	"sync"
+)
+
 type HighWaterMark struct {
+	// FileID is what high water marks are keyed by, so progress follows a file
+	// across renames.
+	FileID FileID
+
+	// FilePath is the path the file was read from. It is kept as metadata only.
 	FilePath string
 
 	// Position is the index in the file after a given line. Seeking to it would
@@ -9,30 +18,54 @@ type HighWaterMark struct {
 }
 
 type Snapshotter interface {
-	HighWaterMark(filePath string) (*HighWaterMark, error)
+	HighWaterMark(fileID FileID, filePath string) (*HighWaterMark, error)
 	SetHighWaterMarks(marks []*HighWaterMark) error
+
+	// PruneHighWaterMarks forgets the high water marks of files that keep
+	// returns false for. Files that are gone must be forgotten, or a new file
+	// that reuses one's FileID would be read from where the old one left off.
+	PruneHighWaterMarks(keep func(fileID FileID) bool) error
 }
 
 type MemorySnapshotter struct {
-	files map[string]int64
+	files map[FileID]int64
+	lock  sync.Mutex
 }
 
-func (s *MemorySnapshotter) HighWaterMark(filePath string) (*HighWaterMark, error) {
-	highWaterMark := &HighWaterMark{FilePath: filePath}
+func (s *MemorySnapshotter) HighWaterMark(fileID FileID, filePath string) (*HighWaterMark, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	highWaterMark := &HighWaterMark{FileID: fileID, FilePath: filePath}
 	if s.files != nil {
-		highWaterMark.Position = s.files[filePath]
+		highWaterMark.Position = s.files[fileID]
 	}
 
 	return highWaterMark, nil
 }
 
 func (s *MemorySnapshotter) SetHighWaterMarks(marks []*HighWaterMark) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.files == nil {
-		s.files = make(map[string]int64)
+		s.files = make(map[FileID]int64)
 	}
 
 	for _, mark := range marks {
-		s.files[mark.FilePath] = mark.Position
+		s.files[mark.FileID] = mark.Position
+	}
+	return nil
+}
+
+func (s *MemorySnapshotter) PruneHighWaterMarks(keep func(fileID FileID) bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for fileID := range s.files {
+		if !keep(fileID) {
+			delete(s.files, fileID)
+		}
 	}
 	return nil
 }
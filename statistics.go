@@ -2,7 +2,9 @@ package butteredscones
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,10 +19,59 @@ type Statistics struct {
 	clients     map[string]*ClientStatistics
 	clientsLock sync.RWMutex
 
+	network *NetworkStatistics
+
+	diskQueue     *DiskQueueStatistics
+	diskQueueLock sync.Mutex
+
 	fileReaderPool *FileReaderPoolStatistics
 
-	files     map[string]*FileStatistics
+	files     map[FileID]*FileStatistics
 	filesLock sync.RWMutex
+
+	// The number of times any file has been found truncated in place
+	truncations int
+
+	// The number of lines in any file filtered out by include_lines or
+	// exclude_lines
+	linesFiltered int
+
+	// The number of lines read from files, the number of lines skipped
+	// because they were longer than MaxLength, and the number of lines dropped
+	// by processors
+	linesRead    int
+	linesSkipped int
+	linesDropped int
+
+	// How long chunks have waited for the global rate limit, and how long each
+	// file group has been held back by its own
+	throttled       time.Duration
+	groupsThrottled map[string]time.Duration
+
+	healthThresholds HealthThresholds
+}
+
+// HealthThresholds are how far behind things may get before Health reports a
+// problem. A zero threshold isn't checked.
+type HealthThresholds struct {
+	// The most bytes any file may have that haven't been acknowledged
+	MaxBytesBehind int64
+
+	// The longest any file with bytes that haven't been acknowledged may go
+	// without progress being snapshotted
+	MaxTimeBehind time.Duration
+
+	// The longest every client may go failing to send before it's a problem.
+	// As long as one client is sending, the others failing isn't a problem.
+	MaxTimeRetrying time.Duration
+}
+
+// Health is an overall verdict on whether things are keeping up.
+type Health struct {
+	Healthy bool `json:"healthy"`
+
+	// What's wrong, if anything
+	Problems []string `json:"problems"`
 }
 
 const (
@@ -42,6 +93,55 @@ type ClientStatistics struct {
 
 	// The number of lines in the last chunk successfully sent to this client
 	LastChunkSize int `json:"last_chunk_size"`
+
+	// The number of bytes of records, as read from files, sent successfully to
+	// the client
+	BytesSent int64 `json:"bytes_sent"`
+
+	// The number of times sending a chunk to the client failed
+	SendErrors int `json:"send_errors"`
+
+	// The number of chunks, or parts of chunks, that had to be retried after
+	// failing to be sent to the client
+	Retries int `json:"retries"`
+
+	// When the client started failing to send, or zero if its last send
+	// succeeded
+	FailingSince time.Time `json:"failing_since"`
+
+	// The number of seconds chunks have waited to be sent to the client
+	// because of its rate limit
+	ThrottledSeconds float64 `json:"throttled_seconds"`
+
+	// How long chunks take to be acknowledged after they are sent
+	sendLatency *histogram
+}
+
+type NetworkStatistics struct {
+	// How chunks are distributed between clients
+	Mode string `json:"mode"`
+
+	// In failover mode, the client chunks are currently being sent to
+	ActiveClient string `json:"active_client,omitempty"`
+
+	// In failover mode, the number of times the active client has changed
+	Failovers int `json:"failovers"`
+
+	// In broadcast mode, the number of chunks that have been sent by some
+	// clients, but not all of them yet
+	BroadcastChunksPending int `json:"broadcast_chunks_pending"`
+}
+
+type DiskQueueStatistics struct {
+	// The number of bytes in the disk queue's segment files
+	Size int64 `json:"size"`
+
+	// The number of lines in the disk queue that haven't been acknowledged yet
+	Lines int `json:"lines"`
+
+	// The number of lines dropped from the disk queue to make room for newer
+	// ones, because it was full
+	LinesDropped int `json:"lines_dropped"`
 }
 
 type FileReaderPoolStatistics struct {
@@ -51,9 +151,21 @@ type FileReaderPoolStatistics struct {
 	// The number of files in the pool that are locked, ready to be sent, but
 	// haven't been yet.
 	Locked int `json:"locked"`
+
+	// The number of files waiting for a reader to be opened for them, because
+	// max_open_files has been reached, in total and for each file group.
+	Waiting        int            `json:"waiting"`
+	WaitingByGroup map[string]int `json:"waiting_by_group"`
 }
 
 type FileStatistics struct {
+	// The path the file was opened at. Files are told apart by their FileID,
+	// since a rotated file and the one that replaced it share a path.
+	Path string `json:"path"`
+
+	// The name of the file group the file belongs to.
+	Group string `json:"group"`
+
 	// The current size of the file.
 	Size int64 `json:"size"`
 
@@ -72,6 +184,21 @@ type FileStatistics struct {
 	// The last time a line from this file was successfully sent and acknowledged
 	// by the remote server.
 	LastSnapshot time.Time `json:"last_snapshot"`
+
+	// The number of times the file has been found truncated in place, causing it
+	// to be read again from the beginning.
+	Truncations int `json:"truncations"`
+
+	// The number of lines that weren't sent because of include_lines or
+	// exclude_lines.
+	LinesFiltered int `json:"lines_filtered"`
+
+	// The number of bytes in the file that haven't been acknowledged, i.e.
+	// Size - SnapshotPosition
+	BytesBehind int64 `json:"bytes_behind"`
+
+	// The number of seconds since LastSnapshot
+	SecondsSinceLastSnapshot float64 `json:"seconds_since_last_snapshot"`
 }
 
 var GlobalStatistics *Statistics = NewStatistics()
@@ -79,8 +206,12 @@ var GlobalStatistics *Statistics = NewStatistics()
 func NewStatistics() *Statistics {
 	return &Statistics{
 		clients:        make(map[string]*ClientStatistics),
+		network:        &NetworkStatistics{},
+		diskQueue:      &DiskQueueStatistics{},
 		fileReaderPool: &FileReaderPoolStatistics{},
-		files:          make(map[string]*FileStatistics),
+		files:          make(map[FileID]*FileStatistics),
+
+		groupsThrottled: make(map[string]time.Duration),
 	}
 }
 
@@ -92,96 +223,442 @@ func (s *Statistics) SetClientStatus(clientName string, status string) {
 	stats.Status = status
 }
 
-func (s *Statistics) IncrementClientLinesSent(clientName string, linesSent int) {
+func (s *Statistics) IncrementClientLinesSent(clientName string, linesSent int, bytesSent int64) {
 	s.filesLock.Lock()
 	defer s.filesLock.Unlock()
 
 	stats := s.ensureClientStatisticsCreated(clientName)
 	stats.LastChunkSize = linesSent
 	stats.LinesSent += linesSent
+	stats.BytesSent += bytesSent
 	stats.LastSendTime = time.Now()
+	stats.FailingSince = time.Time{}
+}
+
+// IncrementClientSendErrors records a failure to send a chunk, and whether
+// it will be retried.
+func (s *Statistics) IncrementClientSendErrors(clientName string, retrying bool) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureClientStatisticsCreated(clientName)
+	stats.SendErrors += 1
+	if stats.FailingSince.IsZero() {
+		stats.FailingSince = time.Now()
+	}
+	if retrying {
+		stats.Retries += 1
+	}
+}
+
+// ObserveClientSendLatency records how long a chunk took to be acknowledged
+// after it was sent.
+func (s *Statistics) ObserveClientSendLatency(clientName string, latency time.Duration) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureClientStatisticsCreated(clientName)
+	stats.sendLatency.Observe(latency.Seconds())
+}
+
+// IncrementClientThrottled records how long a chunk waited to be sent to a
+// client because of its rate limit.
+func (s *Statistics) IncrementClientThrottled(clientName string, d time.Duration) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureClientStatisticsCreated(clientName)
+	stats.ThrottledSeconds += d.Seconds()
+}
+
+func (s *Statistics) DeleteClientStatistics(clientName string) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	delete(s.clients, clientName)
+}
+
+func (s *Statistics) SetNetworkMode(mode string) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	s.network.Mode = mode
+}
+
+func (s *Statistics) SetActiveClient(clientName string) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	s.network.ActiveClient = clientName
+}
+
+func (s *Statistics) IncrementFailovers() {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	s.network.Failovers += 1
+}
+
+func (s *Statistics) IncrementBroadcastChunksPending(delta int) {
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	s.network.BroadcastChunksPending += delta
+}
+
+func (s *Statistics) UpdateDiskQueueStatistics(size int64, lines int) {
+	s.diskQueueLock.Lock()
+	defer s.diskQueueLock.Unlock()
+
+	s.diskQueue.Size = size
+	s.diskQueue.Lines = lines
+}
+
+func (s *Statistics) IncrementDiskQueueLinesDropped(lines int) {
+	s.diskQueueLock.Lock()
+	defer s.diskQueueLock.Unlock()
+
+	s.diskQueue.LinesDropped += lines
+}
+
+func (s *Statistics) IncrementLinesRead(lines int) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.linesRead += lines
+}
+
+func (s *Statistics) IncrementLinesSkipped(lines int) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.linesSkipped += lines
+}
+
+func (s *Statistics) IncrementLinesDropped(lines int) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.linesDropped += lines
+}
+
+func (s *Statistics) IncrementThrottled(d time.Duration) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.throttled += d
+}
+
+func (s *Statistics) IncrementGroupThrottled(group string, d time.Duration) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.groupsThrottled[group] += d
 }
 
 func (s *Statistics) UpdateFileReaderPoolStatistics(available int, locked int) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
 	s.fileReaderPool.Available = available
 	s.fileReaderPool.Locked = locked
 }
 
-func (s *Statistics) SetFilePosition(filePath string, position int64) {
+func (s *Statistics) UpdateFileReaderPoolWaiting(waiting int, byGroup map[string]int) {
 	s.filesLock.Lock()
 	defer s.filesLock.Unlock()
 
-	stats := s.ensureFileStatisticsCreated(filePath)
+	s.fileReaderPool.Waiting = waiting
+	s.fileReaderPool.WaitingByGroup = byGroup
+}
+
+func (s *Statistics) SetFilePosition(fileID FileID, filePath string, position int64) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureFileStatisticsCreated(fileID, filePath)
 	stats.Position = position
 	stats.LastRead = time.Now()
 }
 
-func (s *Statistics) SetFileSnapshotPosition(filePath string, snapshotPosition int64) {
+func (s *Statistics) SetFileSnapshotPosition(fileID FileID, filePath string, snapshotPosition int64) {
 	s.filesLock.Lock()
 	defer s.filesLock.Unlock()
 
-	stats := s.ensureFileStatisticsCreated(filePath)
+	stats := s.ensureFileStatisticsCreated(fileID, filePath)
 	stats.SnapshotPosition = snapshotPosition
 	stats.LastSnapshot = time.Now()
 }
 
-func (s *Statistics) DeleteFileStatistics(filePath string) {
+func (s *Statistics) IncrementFileTruncations(fileID FileID, filePath string) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureFileStatisticsCreated(fileID, filePath)
+	stats.Truncations += 1
+	s.truncations += 1
+}
+
+func (s *Statistics) SetFileGroup(fileID FileID, filePath string, group string) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureFileStatisticsCreated(fileID, filePath)
+	stats.Group = group
+}
+
+// GroupStatistics summarizes how far behind the files in a file group are.
+type GroupStatistics struct {
+	// The number of files in the group being read
+	Files int `json:"files"`
+
+	// The number of bytes in the group's files that haven't been acknowledged
+	BytesBehind int64 `json:"bytes_behind"`
+
+	// The longest any file in the group with bytes that haven't been
+	// acknowledged has gone without progress
+	SecondsBehind float64 `json:"seconds_behind"`
+
+	// The number of seconds the group has been held back by its rate limit
+	ThrottledSeconds float64 `json:"throttled_seconds"`
+}
+
+// GroupStatistics returns statistics for each file group, by name.
+func (s *Statistics) GroupStatistics() map[string]*GroupStatistics {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	groups := make(map[string]*GroupStatistics)
+	for _, stats := range s.files {
+		group, ok := groups[stats.Group]
+		if !ok {
+			group = &GroupStatistics{}
+			groups[stats.Group] = group
+		}
+
+		group.Files += 1
+		if stats.BytesBehind > 0 {
+			group.BytesBehind += stats.BytesBehind
+			if stats.SecondsSinceLastSnapshot > group.SecondsBehind {
+				group.SecondsBehind = stats.SecondsSinceLastSnapshot
+			}
+		}
+	}
+
+	for name, throttled := range s.groupsThrottled {
+		group, ok := groups[name]
+		if !ok {
+			group = &GroupStatistics{}
+			groups[name] = group
+		}
+
+		group.ThrottledSeconds = throttled.Seconds()
+	}
+
+	return groups
+}
+
+func (s *Statistics) IncrementFileLinesFiltered(fileID FileID, filePath string, lines int) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	stats := s.ensureFileStatisticsCreated(fileID, filePath)
+	stats.LinesFiltered += lines
+	s.linesFiltered += lines
+}
+
+func (s *Statistics) DeleteFileStatistics(fileID FileID) {
 	s.filesLock.Lock()
 	defer s.filesLock.Unlock()
 
-	delete(s.files, filePath)
+	delete(s.files, fileID)
 }
 
-// UpdateFileSizeStatistics updates the Size attribute of each file, so it's
-// easier to compare how much progress butteredscones has made through a file.
+// UpdateFileSizeStatistics updates the Size attribute of each file, and the
+// attributes derived from it, so it's easier to compare how much progress
+// butteredscones has made through a file.
 //
 // UpdateFileSizeStatistics should be called before displaying statistics to
-// an end user.
+// an end user, or checking Health.
 func (s *Statistics) UpdateFileSizeStatistics() {
 	s.filesLock.RLock()
-	filePaths := make([]string, 0, len(s.files))
-	for filePath, _ := range s.files {
-		filePaths = append(filePaths, filePath)
+	filePaths := make(map[FileID]string, len(s.files))
+	for fileID, stats := range s.files {
+		filePaths[fileID] = stats.Path
 	}
 	s.filesLock.RUnlock()
 
-	for _, filePath := range filePaths {
-		if stats := s.files[filePath]; stats != nil {
-			fileInfo, err := os.Stat(filePath)
-			if err != nil {
-				// unknown size; maybe it was deleted?
-				stats.Size = int64(-1)
+	// Stat files without holding the lock, so readers aren't held up
+	sizes := make(map[FileID]int64, len(filePaths))
+	for fileID, filePath := range filePaths {
+		sizes[fileID] = fileSize(fileID, filePath)
+	}
+
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	for fileID, size := range sizes {
+		if stats := s.files[fileID]; stats != nil {
+			stats.Size = size
+			if size < 0 {
+				stats.BytesBehind = 0
 			} else {
-				stats.Size = fileInfo.Size()
+				stats.BytesBehind = stats.Size - stats.SnapshotPosition
+			}
+			if !stats.LastSnapshot.IsZero() {
+				stats.SecondsSinceLastSnapshot = time.Since(stats.LastSnapshot).Seconds()
 			}
 		}
 	}
 }
 
+// fileSize returns the size of the file at filePath, or -1 if it's unknown:
+// the file was deleted, or rotated so another file is at its path now.
+func fileSize(fileID FileID, filePath string) int64 {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	if currentID, err := statFileID(file); err != nil || currentID != fileID {
+		return -1
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return -1
+	}
+
+	return fileInfo.Size()
+}
+
+func (s *Statistics) SetHealthThresholds(thresholds HealthThresholds) {
+	s.filesLock.Lock()
+	defer s.filesLock.Unlock()
+
+	s.healthThresholds = thresholds
+}
+
+// Health checks files and clients against the health thresholds.
+func (s *Statistics) Health() *Health {
+	s.filesLock.RLock()
+	defer s.filesLock.RUnlock()
+
+	thresholds := s.healthThresholds
+	problems := make([]string, 0)
+
+	for _, fileID := range s.sortedFileIDs() {
+		stats := s.files[fileID]
+		filePath := stats.Path
+		if thresholds.MaxBytesBehind > 0 && stats.BytesBehind > thresholds.MaxBytesBehind {
+			problems = append(problems, fmt.Sprintf("%s is %d bytes behind", filePath, stats.BytesBehind))
+		}
+		if thresholds.MaxTimeBehind > 0 && stats.BytesBehind > 0 && !stats.LastSnapshot.IsZero() {
+			if behind := time.Since(stats.LastSnapshot); behind > thresholds.MaxTimeBehind {
+				problems = append(problems, fmt.Sprintf("%s has made no progress in %s", filePath, behind))
+			}
+		}
+	}
+
+	if thresholds.MaxTimeRetrying > 0 && len(s.clients) > 0 {
+		failing := 0
+		for _, stats := range s.clients {
+			if !stats.FailingSince.IsZero() && time.Since(stats.FailingSince) > thresholds.MaxTimeRetrying {
+				failing += 1
+			}
+		}
+		if failing == len(s.clients) {
+			problems = append(problems, fmt.Sprintf("every client has been failing for more than %s", thresholds.MaxTimeRetrying))
+		}
+	}
+
+	return &Health{Healthy: len(problems) == 0, Problems: problems}
+}
+
 func (s *Statistics) ensureClientStatisticsCreated(clientName string) *ClientStatistics {
 	// assumes lock is held by the caller
 	if _, ok := s.clients[clientName]; !ok {
-		s.clients[clientName] = &ClientStatistics{}
+		s.clients[clientName] = &ClientStatistics{sendLatency: newHistogram(sendLatencyBuckets)}
 	}
 
 	return s.clients[clientName]
 }
 
-func (s *Statistics) ensureFileStatisticsCreated(filePath string) *FileStatistics {
+func (s *Statistics) ensureFileStatisticsCreated(fileID FileID, filePath string) *FileStatistics {
 	// assumes lock is held by the caller
-	if _, ok := s.files[filePath]; !ok {
-		s.files[filePath] = &FileStatistics{}
+	if _, ok := s.files[fileID]; !ok {
+		s.files[fileID] = &FileStatistics{}
+	}
+	s.files[fileID].Path = filePath
+
+	return s.files[fileID]
+}
+
+// sortedFileIDs returns the IDs of files with statistics, sorted by path.
+func (s *Statistics) sortedFileIDs() []FileID {
+	// assumes lock is held by the caller
+	fileIDs := make([]FileID, 0, len(s.files))
+	for fileID := range s.files {
+		fileIDs = append(fileIDs, fileID)
+	}
+	sort.Sort(fileIDsByPath{fileIDs, s.files})
+
+	return fileIDs
+}
+
+type fileIDsByPath struct {
+	fileIDs []FileID
+	files   map[FileID]*FileStatistics
+}
+
+func (f fileIDsByPath) Len() int      { return len(f.fileIDs) }
+func (f fileIDsByPath) Swap(i, j int) { f.fileIDs[i], f.fileIDs[j] = f.fileIDs[j], f.fileIDs[i] }
+func (f fileIDsByPath) Less(i, j int) bool {
+	a, b := f.files[f.fileIDs[i]].Path, f.files[f.fileIDs[j]].Path
+	if a != b {
+		return a < b
 	}
 
-	return s.files[filePath]
+	return f.fileIDs[i].String() < f.fileIDs[j].String()
 }
 
 func (s *Statistics) MarshalJSON() ([]byte, error) {
+	// Everything is copied out under its lock, since it keeps changing while
+	// it's being marshalled
+	s.filesLock.RLock()
+	clients := make(map[string]ClientStatistics, len(s.clients))
+	for name, stats := range s.clients {
+		clients[name] = *stats
+	}
+	// JSON object keys have to be strings
+	files := make(map[string]FileStatistics, len(s.files))
+	for fileID, stats := range s.files {
+		files[fileID.String()] = *stats
+	}
 	structure := map[string]interface{}{
-		"clients":          s.clients,
-		"file_reader_pool": s.fileReaderPool,
-		"files":            s.files,
+		"clients":           clients,
+		"file_reader_pool":  *s.fileReaderPool,
+		"files":             files,
+		"truncations":       s.truncations,
+		"lines_read":        s.linesRead,
+		"lines_skipped":     s.linesSkipped,
+		"lines_dropped":     s.linesDropped,
+		"lines_filtered":    s.linesFiltered,
+		"throttled_seconds": s.throttled.Seconds(),
 	}
+	s.filesLock.RUnlock()
+
+	s.clientsLock.RLock()
+	structure["network"] = *s.network
+	s.clientsLock.RUnlock()
+
+	s.diskQueueLock.Lock()
+	structure["disk_queue"] = *s.diskQueue
+	s.diskQueueLock.Unlock()
+
+	structure["groups"] = s.GroupStatistics()
+	structure["health"] = s.Health()
 
 	return json.Marshal(structure)
 }
@@ -0,0 +1,213 @@
+package butteredscones
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Upper bounds, in seconds, of the buckets send latencies are counted in
+var sendLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts observations in cumulative buckets, like a Prometheus
+// histogram. It isn't safe for concurrent use; Statistics guards it.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.count += 1
+	h.sum += value
+}
+
+// WritePrometheus writes the statistics in the Prometheus text exposition
+// format, so they can be scraped by Prometheus.
+func (s *Statistics) WritePrometheus(w io.Writer) error {
+	p := &prometheusWriter{w: bufio.NewWriter(w)}
+
+	s.filesLock.RLock()
+	clientNames := make([]string, 0, len(s.clients))
+	for name := range s.clients {
+		clientNames = append(clientNames, name)
+	}
+	sort.Strings(clientNames)
+
+	fileIDs := s.sortedFileIDs()
+	fileReaderPool := *s.fileReaderPool
+
+	p.header("butteredscones_lines_read_total", "counter", "Lines read from files.")
+	p.sample("butteredscones_lines_read_total", nil, float64(s.linesRead))
+	p.header("butteredscones_lines_skipped_total", "counter", "Lines skipped because they were longer than max_length.")
+	p.sample("butteredscones_lines_skipped_total", nil, float64(s.linesSkipped))
+	p.header("butteredscones_lines_dropped_total", "counter", "Lines dropped by processors.")
+	p.sample("butteredscones_lines_dropped_total", nil, float64(s.linesDropped))
+	p.header("butteredscones_lines_filtered_total", "counter", "Lines filtered out by include_lines or exclude_lines.")
+	p.sample("butteredscones_lines_filtered_total", nil, float64(s.linesFiltered))
+	p.header("butteredscones_throttled_seconds_total", "counter", "Time chunks waited for the global rate limit.")
+	p.sample("butteredscones_throttled_seconds_total", nil, s.throttled.Seconds())
+	p.header("butteredscones_file_truncations_total", "counter", "Times a file was found truncated in place.")
+	p.sample("butteredscones_file_truncations_total", nil, float64(s.truncations))
+
+	p.header("butteredscones_client_lines_sent_total", "counter", "Lines sent to and acknowledged by each server.")
+	for _, name := range clientNames {
+		p.sample("butteredscones_client_lines_sent_total", []string{"client", name}, float64(s.clients[name].LinesSent))
+	}
+	p.header("butteredscones_client_bytes_sent_total", "counter", "Bytes of records, as read from files, sent to and acknowledged by each server.")
+	for _, name := range clientNames {
+		p.sample("butteredscones_client_bytes_sent_total", []string{"client", name}, float64(s.clients[name].BytesSent))
+	}
+	p.header("butteredscones_client_send_errors_total", "counter", "Failures sending chunks to each server.")
+	for _, name := range clientNames {
+		p.sample("butteredscones_client_send_errors_total", []string{"client", name}, float64(s.clients[name].SendErrors))
+	}
+	p.header("butteredscones_client_retries_total", "counter", "Chunks retried after failing to be sent to each server.")
+	for _, name := range clientNames {
+		p.sample("butteredscones_client_retries_total", []string{"client", name}, float64(s.clients[name].Retries))
+	}
+	p.header("butteredscones_client_throttled_seconds_total", "counter", "Time chunks waited for each server's rate limit.")
+	for _, name := range clientNames {
+		p.sample("butteredscones_client_throttled_seconds_total", []string{"client", name}, s.clients[name].ThrottledSeconds)
+	}
+	p.header("butteredscones_client_send_latency_seconds", "histogram", "Time from sending a chunk to each server until it is acknowledged.")
+	for _, name := range clientNames {
+		p.histogram("butteredscones_client_send_latency_seconds", []string{"client", name}, s.clients[name].sendLatency)
+	}
+
+	p.header("butteredscones_file_position_bytes", "gauge", "Position read up to in each file.")
+	for _, fileID := range fileIDs {
+		p.sample("butteredscones_file_position_bytes", fileLabels(fileID, s.files[fileID]), float64(s.files[fileID].Position))
+	}
+	p.header("butteredscones_file_snapshot_position_bytes", "gauge", "Position acknowledged up to in each file.")
+	for _, fileID := range fileIDs {
+		p.sample("butteredscones_file_snapshot_position_bytes", fileLabels(fileID, s.files[fileID]), float64(s.files[fileID].SnapshotPosition))
+	}
+	p.header("butteredscones_file_lines_filtered_total", "counter", "Lines in each file filtered out by include_lines or exclude_lines.")
+	for _, fileID := range fileIDs {
+		p.sample("butteredscones_file_lines_filtered_total", fileLabels(fileID, s.files[fileID]), float64(s.files[fileID].LinesFiltered))
+	}
+	p.header("butteredscones_file_lag_bytes", "gauge", "Bytes in each file that haven't been acknowledged yet.")
+	for _, fileID := range fileIDs {
+		if stats := s.files[fileID]; stats.Size >= 0 {
+			p.sample("butteredscones_file_lag_bytes", fileLabels(fileID, stats), float64(stats.Size-stats.SnapshotPosition))
+		}
+	}
+	s.filesLock.RUnlock()
+
+	groups := s.GroupStatistics()
+	groupNames := make([]string, 0, len(groups))
+	for name := range groups {
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+
+	p.header("butteredscones_group_lag_bytes", "gauge", "Bytes in each file group's files that haven't been acknowledged yet.")
+	for _, name := range groupNames {
+		p.sample("butteredscones_group_lag_bytes", []string{"group", name}, float64(groups[name].BytesBehind))
+	}
+	p.header("butteredscones_group_lag_seconds", "gauge", "Longest time any file in each file group with bytes that haven't been acknowledged has made no progress.")
+	for _, name := range groupNames {
+		p.sample("butteredscones_group_lag_seconds", []string{"group", name}, groups[name].SecondsBehind)
+	}
+	p.header("butteredscones_group_throttled_seconds_total", "counter", "Time each file group was held back by its rate limit.")
+	for _, name := range groupNames {
+		p.sample("butteredscones_group_throttled_seconds_total", []string{"group", name}, groups[name].ThrottledSeconds)
+	}
+
+	p.header("butteredscones_file_reader_pool_available", "gauge", "Files in the reader pool that are available to be read.")
+	p.sample("butteredscones_file_reader_pool_available", nil, float64(fileReaderPool.Available))
+	p.header("butteredscones_file_reader_pool_locked", "gauge", "Files in the reader pool whose lines are waiting to be acknowledged.")
+	p.sample("butteredscones_file_reader_pool_locked", nil, float64(fileReaderPool.Locked))
+	p.header("butteredscones_file_reader_pool_waiting", "gauge", "Files waiting for a reader because max_open_files has been reached.")
+	p.sample("butteredscones_file_reader_pool_waiting", nil, float64(fileReaderPool.Waiting))
+
+	s.clientsLock.RLock()
+	p.header("butteredscones_failovers_total", "counter", "Times the active server changed in failover mode.")
+	p.sample("butteredscones_failovers_total", nil, float64(s.network.Failovers))
+	p.header("butteredscones_broadcast_chunks_pending", "gauge", "Chunks sent by some servers but not all of them yet in broadcast mode.")
+	p.sample("butteredscones_broadcast_chunks_pending", nil, float64(s.network.BroadcastChunksPending))
+	s.clientsLock.RUnlock()
+
+	s.diskQueueLock.Lock()
+	p.header("butteredscones_disk_queue_size_bytes", "gauge", "Bytes in the disk queue's segment files.")
+	p.sample("butteredscones_disk_queue_size_bytes", nil, float64(s.diskQueue.Size))
+	p.header("butteredscones_disk_queue_lines", "gauge", "Lines in the disk queue that haven't been acknowledged yet.")
+	p.sample("butteredscones_disk_queue_lines", nil, float64(s.diskQueue.Lines))
+	p.header("butteredscones_disk_queue_lines_dropped_total", "counter", "Lines dropped from the disk queue because it was full.")
+	p.sample("butteredscones_disk_queue_lines_dropped_total", nil, float64(s.diskQueue.LinesDropped))
+	s.diskQueueLock.Unlock()
+
+	return p.w.Flush()
+}
+
+type prometheusWriter struct {
+	w *bufio.Writer
+}
+
+func (p *prometheusWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// fileLabels labels a file's samples with its path, and its device and inode
+// so a rotated file and the one that replaced it are different series.
+func fileLabels(fileID FileID, stats *FileStatistics) []string {
+	return []string{"path", stats.Path, "file_id", fileID.String()}
+}
+
+// sample writes a single sample. labels alternates label names and values.
+func (p *prometheusWriter) sample(name string, labels []string, value float64) {
+	p.w.WriteString(name)
+	if len(labels) > 0 {
+		p.w.WriteString("{")
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				p.w.WriteString(",")
+			}
+			fmt.Fprintf(p.w, "%s=\"%s\"", labels[i], prometheusLabelEscaper.Replace(labels[i+1]))
+		}
+		p.w.WriteString("}")
+	}
+	fmt.Fprintf(p.w, " %s\n", formatPrometheusValue(value))
+}
+
+func (p *prometheusWriter) histogram(name string, labels []string, h *histogram) {
+	for i, bound := range h.buckets {
+		p.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", formatPrometheusValue(bound)), float64(h.counts[i]))
+	}
+	p.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	p.sample(name+"_sum", labels, h.sum)
+	p.sample(name+"_count", labels, float64(h.count))
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
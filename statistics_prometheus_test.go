@@ -0,0 +1,39 @@
+package butteredscones
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatisticsWritePrometheus(t *testing.T) {
+	stats := NewStatistics()
+	stats.IncrementLinesRead(3)
+	stats.IncrementClientLinesSent("logstash:5043", 3, 18)
+	stats.ObserveClientSendLatency("logstash:5043", 20*time.Millisecond)
+	stats.SetFileSnapshotPosition(FileID{Device: 1, Inode: 2}, "/var/log/\"quoted\".log", 12)
+
+	buf := new(bytes.Buffer)
+	if err := stats.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	output := buf.String()
+
+	expected := []string{
+		"# TYPE butteredscones_lines_read_total counter\n",
+		"butteredscones_lines_read_total 3\n",
+		"butteredscones_client_lines_sent_total{client=\"logstash:5043\"} 3\n",
+		"butteredscones_client_bytes_sent_total{client=\"logstash:5043\"} 18\n",
+		"butteredscones_client_send_latency_seconds_bucket{client=\"logstash:5043\",le=\"0.01\"} 0\n",
+		"butteredscones_client_send_latency_seconds_bucket{client=\"logstash:5043\",le=\"0.025\"} 1\n",
+		"butteredscones_client_send_latency_seconds_bucket{client=\"logstash:5043\",le=\"+Inf\"} 1\n",
+		"butteredscones_client_send_latency_seconds_count{client=\"logstash:5043\"} 1\n",
+		"butteredscones_file_snapshot_position_bytes{path=\"/var/log/\\\"quoted\\\".log\",file_id=\"1:2\"} 12\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Fatalf("expected output to contain %q, but got:\n%s", line, output)
+		}
+	}
+}
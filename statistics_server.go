@@ -6,8 +6,12 @@ import (
 )
 
 // StatisticsServer constructs an HTTP server that returns JSON formatted
-// statistics. These statistics can be used for debugging or automated
+// statistics at /, and the same statistics in Prometheus' text format at
+// /metrics. These statistics can be used for debugging or automated
 // monitoring.
+//
+// /health returns the statistics' health verdict, with a 503 status if
+// anything is unhealthy, for load balancers and monitoring checks.
 type StatisticsServer struct {
 	Statistics *Statistics
 	Addr       string
@@ -16,6 +20,8 @@ type StatisticsServer struct {
 func (s *StatisticsServer) ListenAndServe() error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRoot)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/health", s.handleHealth)
 
 	server := &http.Server{
 		Addr:    s.Addr,
@@ -37,3 +43,28 @@ func (s *StatisticsServer) handleRoot(writer http.ResponseWriter, request *http.
 		writer.Write(jsonStats)
 	}
 }
+
+func (s *StatisticsServer) handleMetrics(writer http.ResponseWriter, request *http.Request) {
+	s.Statistics.UpdateFileSizeStatistics()
+
+	writer.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	s.Statistics.WritePrometheus(writer)
+}
+
+func (s *StatisticsServer) handleHealth(writer http.ResponseWriter, request *http.Request) {
+	s.Statistics.UpdateFileSizeStatistics()
+
+	health := s.Statistics.Health()
+	jsonHealth, err := json.Marshal(health)
+	if err != nil {
+		writer.WriteHeader(500)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+
+	writer.Header().Add("Content-Type", "application/json")
+	if !health.Healthy {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writer.Write(jsonHealth)
+}
@@ -0,0 +1,146 @@
+package butteredscones
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatisticsHealth(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := NewStatistics()
+	stats.SetHealthThresholds(HealthThresholds{MaxBytesBehind: 10, MaxTimeRetrying: time.Minute})
+	stats.SetFileSnapshotPosition(fileID, tmpFile.Name(), 0)
+	stats.UpdateFileSizeStatistics()
+
+	if behind := stats.files[fileID].BytesBehind; behind != 12 {
+		t.Fatalf("expected file to be %d bytes behind, but got %d", 12, behind)
+	}
+	if health := stats.Health(); health.Healthy || len(health.Problems) != 1 {
+		t.Fatalf("expected 1 problem, but got %v", health.Problems)
+	}
+
+	stats.SetFileSnapshotPosition(fileID, tmpFile.Name(), 6)
+	stats.UpdateFileSizeStatistics()
+	if health := stats.Health(); !health.Healthy {
+		t.Fatalf("expected to be healthy, but got %v", health.Problems)
+	}
+
+	// One client failing isn't a problem as long as another is sending
+	stats.IncrementClientSendErrors("failing", true)
+	stats.IncrementClientLinesSent("sending", 1, 6)
+	stats.clients["failing"].FailingSince = time.Now().Add(-2 * time.Minute)
+	if health := stats.Health(); !health.Healthy {
+		t.Fatalf("expected to be healthy, but got %v", health.Problems)
+	}
+
+	stats.IncrementClientSendErrors("sending", true)
+	stats.clients["sending"].FailingSince = time.Now().Add(-2 * time.Minute)
+	if health := stats.Health(); health.Healthy {
+		t.Fatalf("expected to be unhealthy once every client is failing")
+	}
+}
+
+func TestStatisticsGroups(t *testing.T) {
+	stats := NewStatistics()
+	audit, app1, app2 := FileID{Inode: 1}, FileID{Inode: 2}, FileID{Inode: 3}
+	stats.SetFileGroup(audit, "/var/log/audit.log", "audit")
+	stats.SetFileGroup(app1, "/var/log/app1.log", "app")
+	stats.SetFileGroup(app2, "/var/log/app2.log", "app")
+
+	stats.files[app1].BytesBehind = 100
+	stats.files[app1].SecondsSinceLastSnapshot = 30
+	stats.files[app2].BytesBehind = 50
+	stats.files[app2].SecondsSinceLastSnapshot = 60
+	// Files that are caught up aren't behind, no matter how long it has been
+	stats.files[audit].SecondsSinceLastSnapshot = 600
+
+	groups := stats.GroupStatistics()
+	if app := groups["app"]; app.Files != 2 || app.BytesBehind != 150 || app.SecondsBehind != 60 {
+		t.Fatalf("expected app group to have 2 files 150 bytes and 60 seconds behind, but got %+v", app)
+	}
+	if audit := groups["audit"]; audit.Files != 1 || audit.BytesBehind != 0 || audit.SecondsBehind != 0 {
+		t.Fatalf("expected audit group not to be behind, but got %+v", audit)
+	}
+}
+
+func TestStatisticsRotatedFile(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated file used to be at the same path as the new one
+	oldID := FileID{Device: newID.Device, Inode: newID.Inode + 1}
+
+	stats := NewStatistics()
+	stats.SetFileSnapshotPosition(oldID, tmpFile.Name(), 100)
+	stats.SetFileSnapshotPosition(newID, tmpFile.Name(), 6)
+	stats.UpdateFileSizeStatistics()
+
+	if old := stats.files[oldID]; old.Size != -1 || old.BytesBehind != 0 {
+		t.Fatalf("expected the rotated file's size to be unknown, but got %+v", old)
+	}
+	if behind := stats.files[newID].BytesBehind; behind != 6 {
+		t.Fatalf("expected new file to be %d bytes behind, but got %d", 6, behind)
+	}
+
+	// Finishing the rotated file doesn't lose the new file's statistics
+	stats.DeleteFileStatistics(oldID)
+	if _, ok := stats.files[newID]; !ok {
+		t.Fatalf("expected new file to still have statistics")
+	}
+}
+
+func TestStatisticsMarshalJSONConcurrently(t *testing.T) {
+	stats := NewStatistics()
+	stats.SetFileGroup(FileID{Inode: 1}, "/var/log/app.log", "app")
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			stats.SetClientStatus(fmt.Sprintf("client%d", i), clientStatusSending)
+			stats.IncrementFailovers()
+			stats.UpdateDiskQueueStatistics(int64(i), i)
+			stats.UpdateFileReaderPoolStatistics(i, i)
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, err := json.Marshal(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,92 @@
+package butteredscones
+
+import (
+	"io"
+	"time"
+)
+
+const streamReaderBufferSize = 32 * 1024
+
+// streamReader reads from a stream, like standard input, in the background.
+// Reading from a stream blocks until more is written to it, which could be a
+// while; Wait lets the reader of a streamReader give up waiting for a moment,
+// e.g. to flush a multiline event that has timed out.
+type streamReader struct {
+	reads chan streamRead
+	stop  <-chan interface{}
+
+	// What has been read in the background, but not by Read yet
+	pending []byte
+	err     error
+}
+
+type streamRead struct {
+	data []byte
+	err  error
+}
+
+// newStreamReader starts reading from r in the background. It stops once r
+// returns an error, or stop is closed, after which Read returns io.EOF.
+func newStreamReader(r io.Reader, stop <-chan interface{}) *streamReader {
+	s := &streamReader{reads: make(chan streamRead), stop: stop}
+	go s.readInBackground(r)
+
+	return s
+}
+
+func (s *streamReader) readInBackground(r io.Reader) {
+	for {
+		buf := make([]byte, streamReaderBufferSize)
+		n, err := r.Read(buf)
+		if n == 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case s.reads <- streamRead{data: buf[:n], err: err}:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Wait waits up to timeout for something to be read, returning true if Read
+// can return without blocking.
+func (s *streamReader) Wait(timeout time.Duration) bool {
+	if len(s.pending) > 0 || s.err != nil {
+		return true
+	}
+
+	select {
+	case <-s.stop:
+		return false
+	case <-time.After(timeout):
+		return false
+	case read := <-s.reads:
+		s.pending, s.err = read.data, read.err
+		return true
+	}
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 && s.err == nil {
+		select {
+		case <-s.stop:
+			s.err = io.EOF
+		case read := <-s.reads:
+			s.pending, s.err = read.data, read.err
+		}
+	}
+
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+
+	return 0, s.err
+}
@@ -1,8 +1,10 @@
 package butteredscones
 
 import (
+	"encoding/json"
 	"os"
-	"path/filepath"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,26 +14,113 @@ import (
 
 const (
 	supervisorReaderChunkSize = 64
+
+	// The most chunks that may be sent to a single client but not acknowledged
+	// yet. Clients may enforce a lower limit of their own.
+	supervisorMaxWindowsInFlight = 64
+
+	// A path of "-" reads from standard input
+	stdinPath = "-"
+
+	// How long a reader may stay open while other files are waiting for a
+	// reader of their own, because of max_open_files
+	supervisorReaderTurn = 30 * time.Second
+
+	// How long to wait for more file watch events before starting readers for
+	// the files they were for, so a file being written to in a loop isn't
+	// looked at for every write
+	supervisorWatchDelay = 100 * time.Millisecond
 )
 
 type Supervisor struct {
-	files       []FileConfiguration
-	clients     []client.Client
 	snapshotter Snapshotter
 
+	// Guards files, clients and the maps of readers below, which may be
+	// replaced by Reload
+	configLock sync.Mutex
+	files      []FileConfiguration
+	clients    []*supervisorClient
+
+	// The file group each reader was started for, and the readers whose group
+	// has since been removed or changed. Retired readers are stopped the next
+	// time they're available, and started again if they still match.
+	readerConfigs  map[*FileReader]FileConfiguration
+	retiredReaders map[*FileReader]bool
+	globRequest    chan interface{}
+
+	// The files found by the glob in progress. High water marks for files that
+	// weren't found, and don't have a reader, are pruned once it's done. Only
+	// used by populateReaderPool.
+	foundFileIDs map[FileID]bool
+
+	// The processors for each reader's file group
+	readerProcessors map[*FileReader][]Processor
+
+	// The file group each reader belongs to, including standard input's, and
+	// the rate limiter for each group that has a rate_limit
+	readerGroups  map[*FileReader]string
+	groupLimiters map[string]*RateLimiter
+
+	// The rate limit for each client that has one. See SetClientRateLimit.
+	clientRateLimits map[client.Client]RateLimitConfiguration
+
 	// Optional settings
 	SpoolSize int
 	MaxLength int
 
+	// The most files that may be open for reading at once. Zero means no
+	// limit. File groups may set a limit of their own, too. Files over the
+	// limit wait their turn in the reader pool.
+	MaxOpenFiles int
+	slotFreed    chan interface{}
+
+	// How long a reader may stay open while other files are waiting. See
+	// supervisorReaderTurn.
+	readerTurn time.Duration
+
+	// Limits how fast chunks are handed to clients, all together
+	RateLimit   RateLimitConfiguration
+	rateLimiter *RateLimiter
+
+	// How chunks are distributed between clients: NetworkModeLoadBalance (the
+	// default), NetworkModeFailover or NetworkModeBroadcast
+	NetworkMode string
+
+	// If set, chunks are written to the disk queue as they are read, and sent
+	// from there. Progress is snapshotted once a chunk is in the queue, rather
+	// than once it is sent, so lines aren't lost if their file is deleted
+	// before the servers catch up. Stop closes it.
+	DiskQueue *DiskQueue
+
 	// How frequently to glob for new files that may have appeared
 	GlobRefresh time.Duration
 	globTimer   *time.Timer
 
+	// The names of the file groups whose paths have been globbed since they
+	// were added or changed, by Start or Reload. Files found in them after that
+	// are new, so they're read from the beginning regardless of
+	// start_position. Guarded by configLock.
+	globbedGroups map[string]bool
+
+	// If set (the default), the directories files may appear in are watched,
+	// so new files and new lines in files that were read to EOF are read right
+	// away rather than at the next GlobRefresh. Where watching isn't
+	// supported, or the limit on watches is reached, GlobRefresh is relied on.
+	WatchFiles bool
+
+	// Standard input, if it is configured as one of the paths to read
+	stdin        *os.File
+	stdinStarted bool
+	stdinDone    chan interface{}
+
 	readerPool  *FileReaderPool
 	readyChunks chan *readyChunk
-	// A separate channel for retries to avoid deadlocking when multiple clients
-	// need to retry.
-	retryChunks chan *readyChunk
+
+	// Set in loadbalance and failover mode, where every client shares a queue
+	sharedQueue *chunkQueue
+
+	// Set in failover mode, to track which client is active
+	failover *failover
 
 	stopRequest chan interface{}
 	routineWg   sync.WaitGroup
@@ -40,30 +129,91 @@ type Supervisor struct {
 type readyChunk struct {
 	Chunk         []*FileData
 	LockedReaders []*FileReader
+
+	// Set in broadcast mode, where each client is sent its own copy of a chunk
+	broadcast *broadcastChunk
+
+	// Set if the chunk was read from the disk queue
+	queueRecord *DiskQueueRecord
+}
+
+// supervisorClient is a client that the supervisor is sending chunks to.
+type supervisorClient struct {
+	client.Client
+	queue *chunkQueue
+
+	// Limits how fast chunks are sent to the client, if it has a rate limit
+	limiter *RateLimiter
+
+	// Closed when the client is removed by Reload. Chunks that were already
+	// sent to it are still acknowledged or retried.
+	removed chan interface{}
+}
+
+// sentChunk is a chunk that has been sent to a client, but may not have been
+// acknowledged yet.
+type sentChunk struct {
+	readyChunk *readyChunk
+	window     *client.Window
+	sentAt     time.Time
 }
 
 func NewSupervisor(files []FileConfiguration, clients []client.Client, snapshotter Snapshotter, maxLength int) *Supervisor {
 	spoolSize := 1024
 
+	supervisorClients := make([]*supervisorClient, 0, len(clients))
+	for _, c := range clients {
+		supervisorClients = append(supervisorClients, newSupervisorClient(c))
+	}
+
 	return &Supervisor{
 		files:       files,
-		clients:     clients,
+		clients:     supervisorClients,
 		snapshotter: snapshotter,
+		stdin:       os.Stdin,
+
+		readerConfigs:  make(map[*FileReader]FileConfiguration),
+		retiredReaders: make(map[*FileReader]bool),
+		globRequest:    make(chan interface{}, 1),
+		globbedGroups:  make(map[string]bool),
+
+		readerProcessors: make(map[*FileReader][]Processor),
+		readerGroups:     make(map[*FileReader]string),
+		groupLimiters:    make(map[string]*RateLimiter),
+		clientRateLimits: make(map[client.Client]RateLimitConfiguration),
+		slotFreed:        make(chan interface{}, 1),
+		readerTurn:       supervisorReaderTurn,
 
 		// Can be adjusted by clients later before calling Start
 		SpoolSize:   spoolSize,
 		MaxLength:   maxLength,
+		NetworkMode: NetworkModeLoadBalance,
 		GlobRefresh: 10 * time.Second,
+		WatchFiles:  true,
 	}
 }
 
 // Start pulls things together and plays match-maker.
 func (s *Supervisor) Start() {
 	s.stopRequest = make(chan interface{})
+	s.stdinDone = make(chan interface{})
 
 	s.readerPool = NewFileReaderPool()
 	s.readyChunks = make(chan *readyChunk, len(s.clients))
-	s.retryChunks = make(chan *readyChunk, len(s.clients))
+	s.rateLimiter = NewRateLimiter(s.RateLimit)
+	GlobalStatistics.SetNetworkMode(s.NetworkMode)
+
+	if s.NetworkMode != NetworkModeBroadcast {
+		// Clients share a queue, so each chunk is sent by only one of them
+		s.sharedQueue = &chunkQueue{
+			ready: s.readyChunks,
+			retry: newRetryQueue(),
+		}
+
+		if s.NetworkMode == NetworkModeFailover {
+			s.failover = newFailover(clientNames(s.clients))
+		}
+	}
 
 	s.routineWg.Add(1)
 	go func() {
@@ -77,19 +227,342 @@ func (s *Supervisor) Start() {
 		s.routineWg.Done()
 	}()
 
-	for _, cli := range s.clients {
+	if s.DiskQueue != nil {
+		s.routineWg.Add(1)
+		go func() {
+			s.readQueuedChunks()
+			s.routineWg.Done()
+		}()
+	}
+
+	for _, c := range s.clients {
+		s.startClient(c)
+	}
+
+	if s.NetworkMode == NetworkModeBroadcast {
+		// Each client gets a queue of its own, so every chunk can be handed to
+		// all of them. The clients' queues are set up by startClient.
 		s.routineWg.Add(1)
-		go func(c client.Client) {
-			s.sendReadyChunksToClient(c)
+		go func() {
+			s.broadcastReadyChunks()
 			s.routineWg.Done()
-		}(cli)
+		}()
+	}
+}
+
+func newSupervisorClient(c client.Client) *supervisorClient {
+	return &supervisorClient{
+		Client:  c,
+		removed: make(chan interface{}),
+	}
+}
+
+func clientNames(clients []*supervisorClient) []string {
+	names := make([]string, 0, len(clients))
+	for _, c := range clients {
+		names = append(names, c.Name())
+	}
+
+	return names
+}
+
+// SetClientRateLimit limits how fast chunks are sent to a client. It takes
+// effect when the client is started, by Start or Reload.
+func (s *Supervisor) SetClientRateLimit(c client.Client, limit RateLimitConfiguration) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	s.clientRateLimits[c] = limit
+}
+
+// startClient starts sending chunks to a client.
+func (s *Supervisor) startClient(c *supervisorClient) {
+	c.limiter = NewRateLimiter(s.clientRateLimits[c.Client])
+	if s.sharedQueue != nil {
+		c.queue = s.sharedQueue
+	} else {
+		c.queue = newChunkQueue(1)
+	}
+
+	s.routineWg.Add(1)
+	go func() {
+		s.sendReadyChunksToClient(c)
+		s.routineWg.Done()
+	}()
+}
+
+// Reload replaces the file groups to read and the clients to send to, e.g.
+// after the configuration file changes. It must be called after Start.
+//
+// Readers for files in groups that are unchanged keep reading where they are.
+// Readers for groups that were removed or changed are stopped once their
+// lines in flight have been acknowledged, and their files are read again from
+// their high water mark. Readers for files that no longer match any group, or
+// have been rotated away from their path, aren't stopped; they keep reading
+// until EOF, so what's left in their files isn't lost.
+//
+// Clients are compared by identity, so clients that are in both the old and
+// new lists keep running. Removed clients stop taking new chunks, but chunks
+// they already sent are still acknowledged or retried.
+func (s *Supervisor) Reload(files []FileConfiguration, clients []client.Client) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	// Files already in new or changed groups may be read from the end
+	for _, config := range files {
+		if !containsFileConfiguration(s.files, config) {
+			delete(s.globbedGroups, config.GroupName())
+		}
+	}
+
+	s.files = files
+	for reader, config := range s.readerConfigs {
+		if !containsFileConfiguration(files, config) {
+			s.retiredReaders[reader] = true
+			// Make sure it's stopped even if it has nothing to read
+			s.readerPool.Wake(reader)
+		}
+	}
+
+	existing := make(map[client.Client]*supervisorClient, len(s.clients))
+	for _, c := range s.clients {
+		existing[c.Client] = c
+	}
+
+	supervisorClients := make([]*supervisorClient, 0, len(clients))
+	added := make([]*supervisorClient, 0, len(clients))
+	for _, c := range clients {
+		if sc, ok := existing[c]; ok {
+			supervisorClients = append(supervisorClients, sc)
+			delete(existing, c)
+		} else {
+			sc := newSupervisorClient(c)
+			supervisorClients = append(supervisorClients, sc)
+			added = append(added, sc)
+		}
+	}
+	s.clients = supervisorClients
+
+	for _, c := range existing {
+		grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "Reload", "client": c.Name(), "status": "removed"})
+		close(c.removed)
+		delete(s.clientRateLimits, c.Client)
+	}
+	if s.failover != nil {
+		s.failover.SetClients(clientNames(s.clients))
+	}
+	for _, c := range added {
+		grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "Reload", "client": c.Name(), "status": "added"})
+		s.startClient(c)
+	}
+
+	// Look for files in new groups right away
+	s.requestGlob()
+}
+
+func containsFileConfiguration(files []FileConfiguration, config FileConfiguration) bool {
+	for _, file := range files {
+		if reflect.DeepEqual(file, config) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentClients returns the clients chunks are being sent to.
+func (s *Supervisor) currentClients() []*supervisorClient {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	return s.clients
+}
+
+// currentFiles returns the file groups being read.
+func (s *Supervisor) currentFiles() []FileConfiguration {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	return s.files
+}
+
+// retireReader stops a reader if its file group was removed or changed by
+// Reload, returning true if it did. If its file wouldn't be found again, it is
+// left to read until EOF instead.
+func (s *Supervisor) retireReader(reader *FileReader) bool {
+	s.configLock.Lock()
+	retired := s.retiredReaders[reader]
+	s.configLock.Unlock()
+
+	if retired && !s.canReopen(reader) {
+		grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "retireReader", "file": reader.FilePath(), "status": "reading until EOF"})
+
+		s.configLock.Lock()
+		delete(s.retiredReaders, reader)
+		s.configLock.Unlock()
+		return false
+	}
+
+	if retired {
+		grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "retireReader", "file": reader.FilePath(), "status": "retired"})
+		s.removeReader(reader)
+		reader.Stop()
+	}
+
+	return retired
+}
+
+// removeReader removes a reader from the pool, so it can be started again by
+// populateReaderPool if the file still needs to be read.
+func (s *Supervisor) removeReader(reader *FileReader) {
+	s.readerPool.Remove(reader)
+	GlobalStatistics.DeleteFileStatistics(reader.FileID())
+
+	s.configLock.Lock()
+	delete(s.readerConfigs, reader)
+	delete(s.retiredReaders, reader)
+	delete(s.readerProcessors, reader)
+	delete(s.readerGroups, reader)
+	s.configLock.Unlock()
+
+	// Let a waiting file have the reader's place
+	select {
+	case s.slotFreed <- nil:
+	default:
+	}
+}
+
+// hasReaderSlot returns true if a reader can be opened for a file in a file
+// group without going over max_open_files.
+func (s *Supervisor) hasReaderSlot(config FileConfiguration) bool {
+	total, inGroup := s.readerPool.OpenCounts(config.GroupName())
+
+	return (s.MaxOpenFiles <= 0 || total < s.MaxOpenFiles) &&
+		(config.MaxOpenFiles <= 0 || inGroup < config.MaxOpenFiles)
+}
+
+// endReaderTurn stops a reader that has been open for a while if files are
+// waiting for a reader because of max_open_files, and one of them could have
+// the reader's place, so that they get a turn. The file goes to the back of
+// the line if there's more to read. Readers for files that won't be found
+// again, like rotated ones, keep reading until EOF. It returns true if the
+// reader was stopped.
+func (s *Supervisor) endReaderTurn(reader *FileReader) bool {
+	if reader.stream || time.Since(reader.openedAt) < s.readerTurn {
+		return false
+	}
+
+	s.configLock.Lock()
+	group := s.readerConfigs[reader].GroupName()
+	s.configLock.Unlock()
+
+	if !s.readerSlotWanted(group) || !s.canReopen(reader) {
+		return false
 	}
+
+	waiting, _ := s.readerPool.WaitingCounts()
+	grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "endReaderTurn", "file": reader.FilePath(), "waiting": waiting, "status": "turn over"})
+	s.removeReader(reader)
+	reader.Stop()
+	s.requestGlob()
+
+	return true
+}
+
+// canReopen returns true if a reader's file is still at the path it was
+// opened at, and a file group matches that path, so it will be found again
+// and read from its high water mark if the reader is stopped. Otherwise, e.g.
+// once the file has been rotated, stopping the reader would lose what's left
+// to read in it.
+func (s *Supervisor) canReopen(reader *FileReader) bool {
+	if reader.stream {
+		return false
+	}
+
+	if _, ok := matchingFileConfiguration(s.currentFiles(), reader.FilePath()); !ok {
+		return false
+	}
+
+	fileID, err := fileIDAt(reader.FilePath())
+	return err == nil && fileID == reader.FileID()
+}
+
+// readerSlotWanted returns true if a waiting file could be opened in place of
+// a reader in a file group: one in the same group, or one that is only waiting
+// because of the global max_open_files. Files waiting because their own group
+// is full gain nothing from a reader in another group being stopped.
+func (s *Supervisor) readerSlotWanted(group string) bool {
+	for _, waiting := range s.readerPool.Waiting() {
+		name := waiting.Config.GroupName()
+		if name == group {
+			return true
+		}
+
+		if s.MaxOpenFiles > 0 {
+			_, inGroup := s.readerPool.OpenCounts(name)
+			if waiting.Config.MaxOpenFiles <= 0 || inGroup < waiting.Config.MaxOpenFiles {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// byPriority sorts waiting files by the priority of their file group, highest
+// first.
+type byPriority []*WaitingFile
+
+func (w byPriority) Len() int           { return len(w) }
+func (w byPriority) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+func (w byPriority) Less(i, j int) bool { return w[i].Config.Priority > w[j].Config.Priority }
+
+// requestGlob asks populateReaderPool to glob for files right away.
+func (s *Supervisor) requestGlob() {
+	select {
+	case s.globRequest <- nil:
+	default:
+	}
+}
+
+// startWaitingFiles starts readers for files waiting for one, for as long as
+// there's room. Files in groups with a higher priority go first; otherwise,
+// files go in the order they started waiting. The rest keep waiting.
+func (s *Supervisor) startWaitingFiles() {
+	files := s.currentFiles()
+	waitingFiles := s.readerPool.TakeWaiting()
+	sort.Stable(byPriority(waitingFiles))
+
+	for _, waiting := range waitingFiles {
+		if !containsFileConfiguration(files, waiting.Config) {
+			// Its group was removed or changed by Reload
+			continue
+		}
+
+		if err := s.startFileReader(waiting.Path, waiting.Config); err != nil && !os.IsNotExist(err) {
+			grohl.Report(err, grohl.Data{"ns": "Supervisor", "fn": "startWaitingFiles", "filePath": waiting.Path, "msg": "failed to start reader", "resolution": "skipping file"})
+		}
+	}
+
+	waiting, byGroup := s.readerPool.WaitingCounts()
+	GlobalStatistics.UpdateFileReaderPoolWaiting(waiting, byGroup)
+}
+
+// StdinDone is closed once standard input has been read to EOF and every
+// line read from it has been acknowledged. It is never closed if standard
+// input isn't configured as one of the paths to read.
+func (s *Supervisor) StdinDone() <-chan interface{} {
+	return s.stdinDone
 }
 
 // Stop stops the supervisor cleanly, making sure all progress has been snapshotted
 // before exiting.
 func (s *Supervisor) Stop() {
 	close(s.stopRequest)
+	if s.DiskQueue != nil {
+		// Wake up anything waiting on the queue
+		s.DiskQueue.Close()
+	}
 	s.routineWg.Wait()
 }
 
@@ -98,7 +571,9 @@ func (s *Supervisor) Stop() {
 func (s *Supervisor) populateReadyChunks() {
 	logger := grohl.NewContext(grohl.Data{"ns": "Supervisor", "fn": "populateReadyChunks"})
 
-	backoff := &ExponentialBackoff{Minimum: 50 * time.Millisecond, Maximum: 5000 * time.Millisecond}
+	// When each file group's throttled readers will be let through again
+	throttledUntil := make(map[string]time.Time)
+
 	for {
 		available, locked := s.readerPool.Counts()
 		GlobalStatistics.UpdateFileReaderPoolStatistics(available, locked)
@@ -109,28 +584,84 @@ func (s *Supervisor) populateReadyChunks() {
 		}
 
 		for len(currentChunk.Chunk) < s.SpoolSize {
-			if reader := s.readerPool.LockNext(); reader != nil {
+			var reader *FileReader
+			if len(currentChunk.Chunk) == 0 {
+				// Nothing to send yet, so wait for something to be read
+				if reader = s.readerPool.LockNext(s.stopRequest); reader == nil {
+					return
+				}
+			} else {
+				reader = s.readerPool.TryLockNext()
+			}
+
+			if reader != nil {
+				if s.retireReader(reader) || s.endReaderTurn(reader) {
+					continue
+				}
+
+				group, limiter := s.readerRateLimiter(reader)
+				if delay := limiter.Delay(); delay > 0 {
+					// The reader's file group has read as much as it may for now.
+					// Give the other groups a turn.
+					s.readerPool.Throttle(reader, delay)
+
+					// The group's readers are throttled at the same time, so only
+					// count time the group wasn't already throttled for
+					now := time.Now()
+					from, until := now, now.Add(delay)
+					if throttledUntil[group].After(from) {
+						from = throttledUntil[group]
+					}
+					if until.After(from) {
+						GlobalStatistics.IncrementGroupThrottled(group, until.Sub(from))
+						throttledUntil[group] = until
+					}
+					continue
+				}
+
 				select {
 				case <-s.stopRequest:
 					return
 				case chunk := <-reader.C:
 					if chunk != nil {
-						currentChunk.Chunk = append(currentChunk.Chunk, chunk...)
-						currentChunk.LockedReaders = append(currentChunk.LockedReaders, reader)
-
+						GlobalStatistics.IncrementLinesRead(len(chunk))
 						if len(chunk) > 0 {
 							if hwm := chunk[len(chunk)-1].HighWaterMark; hwm != nil {
-								GlobalStatistics.SetFilePosition(hwm.FilePath, hwm.Position)
+								GlobalStatistics.SetFilePosition(hwm.FileID, hwm.FilePath, hwm.Position)
+							}
+						}
+
+						processed := s.processChunk(reader, chunk)
+						if len(processed) == 0 {
+							// Every event was dropped, so there's nothing to wait for
+							if err := s.acknowledgeChunk(chunk); err != nil {
+								logger.Report(err, grohl.Data{"msg": "failed to acknowledge progress", "resolution": "skipping"})
 							}
+							s.readerPool.Unlock(reader)
+							continue
 						}
+
+						limiter.Take(len(processed), recordBytes(processed))
+
+						currentChunk.Chunk = append(currentChunk.Chunk, processed...)
+						currentChunk.LockedReaders = append(currentChunk.LockedReaders, reader)
 					} else {
 						// The reader hit EOF or another error. Remove it and it'll get
 						// picked up by populateReaderPool again if it still needs to be
 						// read.
 						logger.Log(grohl.Data{"status": "EOF", "file": reader.FilePath()})
 
-						s.readerPool.Remove(reader)
-						GlobalStatistics.DeleteFileStatistics(reader.FilePath())
+						s.removeReader(reader)
+
+						// Readers stay locked until their lines are acknowledged (or
+						// queued on disk), so everything read from standard input has
+						// been by now. It is the only stream that's read.
+						if reader.stream && s.DiskQueue != nil {
+							s.routineWg.Add(1)
+							go s.waitForQueuedStdin()
+						} else if reader.stream {
+							close(s.stdinDone)
+						}
 					}
 				default:
 					// The reader didn't have anything queued up for us. Unlock the
@@ -138,110 +669,530 @@ func (s *Supervisor) populateReadyChunks() {
 					s.readerPool.Unlock(reader)
 				}
 			} else {
-				// If there are no more readers, send the chunk ASAP so we can get
-				// the next chunk in line
-				logger.Log(grohl.Data{"msg": "no readers available", "resolution": "sending current chunk"})
+				// If there are no more readers ready, send the chunk ASAP so we can
+				// get the next chunk in line
+				logger.Log(grohl.Data{"msg": "no readers ready", "resolution": "sending current chunk"})
 				break
 			}
 		}
 
-		if len(currentChunk.Chunk) > 0 {
+		if len(currentChunk.Chunk) > 0 && s.DiskQueue != nil {
+			err := s.queueChunk(currentChunk)
+			if err == ErrDiskQueueClosed {
+				return
+			} else if err != nil {
+				logger.Report(err, grohl.Data{"msg": "failed to queue chunk", "resolution": "sending without queueing"})
+				if !s.throttle(currentChunk.Chunk) {
+					return
+				}
+				select {
+				case <-s.stopRequest:
+					return
+				case s.readyChunks <- currentChunk:
+					// continue
+				}
+			}
+		} else if len(currentChunk.Chunk) > 0 {
+			if !s.throttle(currentChunk.Chunk) {
+				return
+			}
 			select {
 			case <-s.stopRequest:
 				return
 			case s.readyChunks <- currentChunk:
-				backoff.Reset()
+				// continue
 			}
-		} else {
+		}
+	}
+}
+
+// processChunk runs the processors for a reader's file group over a chunk it
+// read, returning what's left to send.
+func (s *Supervisor) processChunk(reader *FileReader, chunk []*FileData) []*FileData {
+	s.configLock.Lock()
+	processors := s.readerProcessors[reader]
+	s.configLock.Unlock()
+
+	processed, dropped := processChunk(processors, chunk)
+	if dropped > 0 {
+		GlobalStatistics.IncrementLinesDropped(dropped)
+	}
+
+	return processed
+}
+
+// readerRateLimiter returns the file group a reader belongs to, and the group's
+// rate limiter, if it has one.
+func (s *Supervisor) readerRateLimiter(reader *FileReader) (string, *RateLimiter) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	group := s.readerGroups[reader]
+	return group, s.groupLimiters[group]
+}
+
+// setReaderGroup records the file group a reader belongs to, and sets up a
+// rate limiter for the group if it needs one. Assumes configLock is held by
+// the caller.
+func (s *Supervisor) setReaderGroup(reader *FileReader, config FileConfiguration) {
+	group := config.GroupName()
+	s.readerGroups[reader] = group
+
+	// Files already being read in the group share its limiter, unless Reload
+	// changed the limit
+	if limiter := s.groupLimiters[group]; limiter.Limit() != config.RateLimit {
+		s.groupLimiters[group] = NewRateLimiter(config.RateLimit)
+	}
+}
+
+// throttle waits for the global rate limit to let a chunk be handed to
+// clients. It returns false if the supervisor is stopped first.
+func (s *Supervisor) throttle(chunk []*FileData) bool {
+	wait, ok := s.waitForRateLimit(s.rateLimiter, chunk)
+	if wait > 0 {
+		GlobalStatistics.IncrementThrottled(wait)
+	}
+
+	return ok
+}
+
+// waitForRateLimit waits until a rate limiter lets more through, then takes a
+// chunk from it. Chunks bigger than the limiter allows go through, but make
+// the next one wait longer. It returns how long it waited, and false if the
+// supervisor is stopped first.
+func (s *Supervisor) waitForRateLimit(limiter *RateLimiter, chunk []*FileData) (time.Duration, bool) {
+	wait := limiter.Delay()
+	if wait > 0 {
+		select {
+		case <-s.stopRequest:
+			return wait, false
+		case <-time.After(wait):
+			// continue
+		}
+	}
+
+	limiter.Take(len(chunk), recordBytes(chunk))
+	return wait, true
+}
+
+// queueChunk writes a chunk to the disk queue. Once it's there, progress can
+// be snapshotted and its readers can move on; readQueuedChunks takes it from
+// there.
+func (s *Supervisor) queueChunk(chunk *readyChunk) error {
+	lines := make([]client.Data, 0, len(chunk.Chunk))
+	for _, fileData := range chunk.Chunk {
+		lines = append(lines, fileData.Data)
+	}
+
+	if err := s.DiskQueue.Push(lines); err != nil {
+		return err
+	}
+
+	if err := s.acknowledgeChunk(chunk.Chunk); err != nil {
+		grohl.Report(err, grohl.Data{"msg": "failed to acknowledge progress", "resolution": "skipping"})
+	}
+	s.readerPool.UnlockAll(chunk.LockedReaders)
+
+	return nil
+}
+
+// waitForQueuedStdin closes stdinDone once the disk queue has sent everything
+// in it, including every line queued from standard input.
+func (s *Supervisor) waitForQueuedStdin() {
+	defer s.routineWg.Done()
+
+	if err := s.DiskQueue.WaitForAcks(); err != nil {
+		return
+	}
+	close(s.stdinDone)
+}
+
+// readQueuedChunks reads chunks from the disk queue, putting them on the
+// readyChunks channel to be sent to clients. Each is removed from the queue
+// once it has been completely sent.
+func (s *Supervisor) readQueuedChunks() {
+	backoff := &ExponentialBackoff{Minimum: 50 * time.Millisecond, Maximum: 5000 * time.Millisecond}
+	for {
+		record, err := s.DiskQueue.Next()
+		if err == ErrDiskQueueClosed {
+			return
+		} else if err != nil {
+			grohl.Report(err, grohl.Data{"msg": "failed to read from disk queue", "resolution": "retrying"})
 			select {
 			case <-s.stopRequest:
 				return
 			case <-time.After(backoff.Next()):
-				grohl.Log(grohl.Data{"msg": "no lines available to send", "resolution": "backing off"})
+				continue
 			}
 		}
+		backoff.Reset()
+
+		chunk := &readyChunk{
+			Chunk:       make([]*FileData, 0, len(record.Lines)),
+			queueRecord: record,
+		}
+		for _, line := range record.Lines {
+			// Progress was snapshotted when the chunk was queued. The records
+			// the lines were read from aren't kept, so the size of each line as
+			// it was queued stands in for them.
+			chunk.Chunk = append(chunk.Chunk, &FileData{Data: line, Length: queuedLength(line)})
+		}
+
+		if !s.throttle(chunk.Chunk) {
+			return
+		}
+		select {
+		case <-s.stopRequest:
+			return
+		case s.readyChunks <- chunk:
+			// continue
+		}
 	}
 }
 
-// sendReadyChunksToClient reads from the readyChunks channel for a particular
-// client, sending those chunks to the remote system. This function is also
-// responsible for snapshotting progress and unlocking the readers after it has
-// successfully sent.
-func (s *Supervisor) sendReadyChunksToClient(client client.Client) {
-	backoff := &ExponentialBackoff{Minimum: 50 * time.Millisecond, Maximum: 5000 * time.Millisecond}
+// broadcastReadyChunks hands a copy of each chunk from the readyChunks channel
+// to every client's queue, in broadcast mode.
+func (s *Supervisor) broadcastReadyChunks() {
+	// Clients chunks have been handed to. Once a client is removed, its queue
+	// is closed so it knows nothing more will be handed to it.
+	known := make(map[*supervisorClient]bool)
+
 	for {
-		var readyChunk *readyChunk
+		var chunk *readyChunk
 		select {
 		case <-s.stopRequest:
 			return
-		case readyChunk = <-s.retryChunks:
-			// got a retry chunk; use it
-		default:
-			// pull from the default readyChunk queue
+		case chunk = <-s.readyChunks:
+			// got a chunk
+		}
+
+		clients := s.currentClients()
+		for len(clients) == 0 {
+			// Hold on to the chunk until there's someone to send it to
 			select {
 			case <-s.stopRequest:
 				return
-			case readyChunk = <-s.readyChunks:
+			case <-time.After(time.Second):
+				clients = s.currentClients()
+			}
+		}
+
+		current := make(map[*supervisorClient]bool, len(clients))
+		for _, c := range clients {
+			current[c] = true
+			known[c] = true
+		}
+		for c := range known {
+			if !current[c] {
+				close(c.queue.ready)
+				delete(known, c)
+			}
+		}
+
+		broadcast := &broadcastChunk{chunk: chunk, remaining: int32(len(clients))}
+		GlobalStatistics.IncrementBroadcastChunksPending(1)
+
+		for _, c := range clients {
+			clientChunk := &readyChunk{Chunk: chunk.Chunk, broadcast: broadcast}
+			select {
+			case <-s.stopRequest:
+				return
+			case c.queue.ready <- clientChunk:
+				// continue
+			case <-c.removed:
+				s.finishBroadcastChunk(clientChunk)
+			}
+		}
+	}
+}
+
+// sendReadyChunksToClient reads from a queue of ready chunks for a particular
+// client, sending those chunks to the remote system. Chunks are handed off to
+// acknowledgeSentChunks once they are sent, so that clients that can have
+// several windows in flight don't wait for each to be acknowledged before
+// sending the next.
+func (s *Supervisor) sendReadyChunksToClient(c *supervisorClient) {
+	sentChunks := make(chan *sentChunk, supervisorMaxWindowsInFlight)
+	s.routineWg.Add(1)
+	go func() {
+		s.acknowledgeSentChunks(c, sentChunks)
+		s.routineWg.Done()
+	}()
+	defer close(sentChunks)
+
+	queue := c.queue
+	backoff := &ExponentialBackoff{Minimum: 50 * time.Millisecond, Maximum: 5000 * time.Millisecond}
+	for {
+		// In failover mode, only the active client sends
+		if s.failover != nil && !s.failover.WaitUntilActive(c.Name(), s.stopRequest) {
+			return
+		}
+
+		// Retry chunks go first
+		readyChunk := queue.retry.Pop()
+		if readyChunk == nil {
+			// pull from the default readyChunk queue, unless a retry shows up
+			// first
+			select {
+			case <-s.stopRequest:
+				return
+			case <-c.removed:
+				return
+			case <-queue.retry.Ready():
+				// another client may have taken it first
+				readyChunk = queue.retry.Pop()
+			case readyChunk = <-queue.ready:
 				// got a chunk
 			}
 		}
 
 		if readyChunk != nil {
-			GlobalStatistics.SetClientStatus(client.Name(), clientStatusSending)
-			if err := s.sendChunk(client, readyChunk.Chunk); err != nil {
+			wait, ok := s.waitForRateLimit(c.limiter, readyChunk.Chunk)
+			if wait > 0 {
+				GlobalStatistics.IncrementClientThrottled(c.Name(), wait)
+			}
+			if !ok {
+				return
+			}
+
+			GlobalStatistics.SetClientStatus(c.Name(), clientStatusSending)
+			sentAt := time.Now()
+			window, err := s.sendChunk(c.Client, readyChunk.Chunk)
+			if err != nil {
 				grohl.Report(err, grohl.Data{"msg": "failed to send chunk", "resolution": "retrying"})
-				GlobalStatistics.SetClientStatus(client.Name(), clientStatusRetrying)
+				GlobalStatistics.SetClientStatus(c.Name(), clientStatusRetrying)
+				GlobalStatistics.IncrementClientSendErrors(c.Name(), true)
+				if s.failover != nil {
+					s.failover.Failed(c.Name())
+				}
 
 				// Put the chunk back on the queue for someone else to try
+				queue.retry.Push(readyChunk)
+
+				// Backoff
 				select {
 				case <-s.stopRequest:
 					return
-				case s.retryChunks <- readyChunk:
+				case <-time.After(backoff.Next()):
 					// continue
 				}
+			} else {
+				backoff.Reset()
 
-				// Backoff
 				select {
 				case <-s.stopRequest:
 					return
-				case <-time.After(backoff.Next()):
+				case sentChunks <- &sentChunk{readyChunk: readyChunk, window: window, sentAt: sentAt}:
 					// continue
 				}
-			} else {
-				backoff.Reset()
-				GlobalStatistics.IncrementClientLinesSent(client.Name(), len(readyChunk.Chunk))
+			}
+		}
+	}
+}
+
+// acknowledgeSentChunks waits for chunks sent to a particular client to be
+// acknowledged, in the order they were sent. This function is responsible for
+// snapshotting progress and unlocking the readers after each chunk has
+// successfully been sent, or putting whatever wasn't acknowledged back on the
+// queue to be retried.
+func (s *Supervisor) acknowledgeSentChunks(c *supervisorClient, sentChunks <-chan *sentChunk) {
+	queue := c.queue
+	for {
+		var sent *sentChunk
+		var ok bool
+		select {
+		case <-s.stopRequest:
+			return
+		case sent, ok = <-sentChunks:
+			// got a chunk
+		}
+
+		if !ok {
+			// The client was removed, and everything sent to it is accounted for
+			s.removeClient(c)
+			return
+		}
+
+		select {
+		case <-s.stopRequest:
+			return
+		case <-sent.window.Done():
+			// acknowledged, partially or completely
+		}
+
+		readyChunk := sent.readyChunk
+		acked, err := sent.window.Result()
+		if err == nil {
+			GlobalStatistics.ObserveClientSendLatency(c.Name(), time.Since(sent.sentAt))
+		}
+		if acked > 0 {
+			GlobalStatistics.IncrementClientLinesSent(c.Name(), acked, recordBytes(readyChunk.Chunk[:acked]))
 
-				// Snapshot progress
-				if err := s.acknowledgeChunk(readyChunk.Chunk); err != nil {
+			// Snapshot progress for the lines that were acknowledged, even if
+			// the rest of them weren't. In broadcast mode, progress can't be
+			// snapshotted until every client has sent the whole chunk.
+			if readyChunk.broadcast == nil {
+				if err := s.acknowledgeChunk(readyChunk.Chunk[:acked]); err != nil {
 					grohl.Report(err, grohl.Data{"msg": "failed to acknowledge progress", "resolution": "skipping"})
 				}
+			}
+		}
+
+		if err != nil && readyChunk.broadcast != nil && isClosed(c.removed) {
+			// Nobody else will send this client's copy of the chunk
+			grohl.Report(err, grohl.Data{"msg": "failed to send chunk", "acked": acked, "resolution": "client removed; skipping"})
+			GlobalStatistics.IncrementClientSendErrors(c.Name(), false)
+			s.finishBroadcastChunk(readyChunk)
+		} else if err != nil {
+			grohl.Report(err, grohl.Data{"msg": "failed to send chunk", "acked": acked, "resolution": "retrying"})
+			GlobalStatistics.SetClientStatus(c.Name(), clientStatusRetrying)
+			GlobalStatistics.IncrementClientSendErrors(c.Name(), true)
+			if s.failover != nil {
+				s.failover.Failed(c.Name())
+			}
+
+			// Put the rest of the chunk back on the queue for someone else to
+			// try. The readers stay locked until all of it has been sent.
+			readyChunk.Chunk = readyChunk.Chunk[acked:]
+			queue.retry.Push(readyChunk)
+		} else {
+			if s.failover != nil {
+				s.failover.Succeeded(c.Name())
+			}
+
+			if readyChunk.broadcast == nil {
+				s.releaseChunk(readyChunk)
+			} else {
+				s.finishBroadcastChunk(readyChunk)
+			}
+		}
+	}
+}
+
+// removeClient cleans up after a client removed by Reload, once nothing it
+// sent is waiting to be acknowledged. In broadcast mode, chunks still in its
+// queue are skipped so the other clients' progress isn't held up.
+func (s *Supervisor) removeClient(c *supervisorClient) {
+	if s.sharedQueue == nil && !s.skipQueuedBroadcastChunks(c) {
+		return
+	}
+
+	if disconnecter, ok := c.Client.(interface {
+		Disconnect() error
+	}); ok {
+		disconnecter.Disconnect()
+	}
+	GlobalStatistics.DeleteClientStatistics(c.Name())
+}
+
+// skipQueuedBroadcastChunks finishes the chunks left in a removed client's
+// queue without sending them. It returns false if the supervisor is stopped
+// first.
+func (s *Supervisor) skipQueuedBroadcastChunks(c *supervisorClient) bool {
+	// Nothing else puts chunks on the retry queue by now
+	for readyChunk := c.queue.retry.Pop(); readyChunk != nil; readyChunk = c.queue.retry.Pop() {
+		s.finishBroadcastChunk(readyChunk)
+	}
 
-				s.readerPool.UnlockAll(readyChunk.LockedReaders)
+	// broadcastReadyChunks closes the queue once it knows the client was
+	// removed
+	for {
+		select {
+		case <-s.stopRequest:
+			return false
+		case readyChunk, ok := <-c.queue.ready:
+			if !ok {
+				return true
 			}
+			s.finishBroadcastChunk(readyChunk)
+		}
+	}
+}
+
+// finishBroadcastChunk records that one more client is done with its copy of
+// a chunk in broadcast mode. Once every client is, progress is snapshotted
+// and the chunk is released.
+func (s *Supervisor) finishBroadcastChunk(clientChunk *readyChunk) {
+	if !clientChunk.broadcast.Acknowledge() {
+		return
+	}
+	GlobalStatistics.IncrementBroadcastChunksPending(-1)
+
+	chunk := clientChunk.broadcast.chunk
+	if err := s.acknowledgeChunk(chunk.Chunk); err != nil {
+		grohl.Report(err, grohl.Data{"msg": "failed to acknowledge progress", "resolution": "skipping"})
+	}
+	s.releaseChunk(chunk)
+}
+
+func isClosed(ch <-chan interface{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseChunk is called once a chunk has been completely sent, unlocking its
+// readers or removing it from the disk queue.
+func (s *Supervisor) releaseChunk(chunk *readyChunk) {
+	s.readerPool.UnlockAll(chunk.LockedReaders)
+
+	if chunk.queueRecord != nil {
+		if err := s.DiskQueue.Ack(chunk.queueRecord.ID); err != nil {
+			grohl.Report(err, grohl.Data{"msg": "failed to remove chunk from disk queue", "resolution": "skipping"})
 		}
 	}
 }
 
-func (s *Supervisor) sendChunk(c client.Client, chunk []*FileData) error {
+// sendChunk sends a chunk to a client, without waiting for it to be
+// acknowledged if the client is a client.PipelinedClient. Pass the client
+// itself rather than its supervisorClient, which hides whether it is.
+func (s *Supervisor) sendChunk(c client.Client, chunk []*FileData) (*client.Window, error) {
 	lines := make([]client.Data, 0, len(chunk))
 	for _, fileData := range chunk {
 		lines = append(lines, fileData.Data)
 	}
 
-	return c.Send(lines)
+	return client.SendWindow(c, lines)
+}
+
+// queuedLength returns the size of a line as it is encoded in the disk queue.
+func queuedLength(line client.Data) int64 {
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return 0
+	}
+
+	return int64(len(encoded))
+}
+
+// recordBytes returns the number of bytes of the records a chunk's events
+// were read from.
+func recordBytes(chunk []*FileData) int64 {
+	var bytes int64
+	for _, fileData := range chunk {
+		bytes += fileData.Length
+	}
+
+	return bytes
 }
 
 func (s *Supervisor) acknowledgeChunk(chunk []*FileData) error {
 	marks := make([]*HighWaterMark, 0, len(chunk))
 	for _, fileData := range chunk {
-		marks = append(marks, fileData.HighWaterMark)
+		// Lines read from streams like standard input have no high water mark
+		if fileData.HighWaterMark != nil {
+			marks = append(marks, fileData.HighWaterMark)
+		}
 	}
 
 	err := s.snapshotter.SetHighWaterMarks(marks)
 	if err == nil {
 		// Update statistics
 		for _, mark := range marks {
-			GlobalStatistics.SetFileSnapshotPosition(mark.FilePath, mark.Position)
+			GlobalStatistics.SetFileSnapshotPosition(mark.FileID, mark.FilePath, mark.Position)
 		}
 	}
 
@@ -253,49 +1204,214 @@ func (s *Supervisor) acknowledgeChunk(chunk []*FileData) error {
 func (s *Supervisor) populateReaderPool() {
 	logger := grohl.NewContext(grohl.Data{"ns": "Supervisor", "fn": "populateReaderPool"})
 
+	var watcher fileWatcher
+	var watchEvents <-chan fileWatchEvent
+	if s.WatchFiles {
+		var err error
+		if watcher, err = newFileWatcher(); err != nil {
+			logger.Report(err, grohl.Data{"msg": "failed to watch files", "resolution": "polling"})
+		} else {
+			defer watcher.Close()
+			watchEvents = watcher.Events()
+		}
+	}
+	watchLimitReached := false
+
+	// Paths that watch events came in for, which are looked at together once
+	// events settle down
+	watchedPaths := make(map[string]bool)
+	var watchDelay <-chan time.Time
+
 	timer := time.NewTimer(0)
 	for {
 		select {
 		case <-s.stopRequest:
 			return
+		case <-s.globRequest:
+			timer.Reset(0)
+		case event, ok := <-watchEvents:
+			if !ok {
+				watchEvents = nil
+				continue
+			}
+
+			if event.Path == "" || event.Dir {
+				// Events were lost, or there's a new directory to watch
+				timer.Reset(0)
+				continue
+			}
+			watchedPaths[event.Path] = true
+			if watchDelay == nil {
+				watchDelay = time.After(supervisorWatchDelay)
+			}
+		case <-watchDelay:
+			s.startWatchedFiles(watchedPaths)
+			watchedPaths = make(map[string]bool)
+			watchDelay = nil
+		case <-s.slotFreed:
+			s.startWaitingFiles()
 		case <-timer.C:
 			logTimer := logger.Timer(grohl.Data{})
-			for _, config := range s.files {
+			s.foundFileIDs = make(map[FileID]bool)
+			complete := true
+
+			// Files that are already waiting go ahead of newly found ones
+			s.startWaitingFiles()
+			patterns := make([]string, 0)
+			for _, config := range s.currentFiles() {
+				patterns = append(patterns, config.Paths...)
 				for _, path := range config.Paths {
-					matches, err := filepath.Glob(path)
+					if path == stdinPath {
+						if err := s.startStdinReader(config); err != nil {
+							logger.Report(err, grohl.Data{"path": path, "msg": "failed to start reader", "resolution": "skipping path"})
+						}
+						continue
+					}
+
+					matches, err := globFiles(path, config.ExcludePaths)
 					if err != nil {
 						logger.Report(err, grohl.Data{"path": path, "msg": "failed to glob", "resolution": "skipping path"})
+						complete = false
 						continue
 					}
 
 					for _, filePath := range matches {
-						if err = s.startFileReader(filePath, config.Fields); err != nil {
+						if err = s.startFileReader(filePath, config); err != nil {
 							logger.Report(err, grohl.Data{"path": path, "filePath": filePath, "msg": "failed to start reader", "resolution": "skipping file"})
+							if !os.IsNotExist(err) {
+								complete = false
+							}
 						}
 					}
 				}
+				s.setGroupGlobbed(config)
 			}
 			logTimer.Finish()
+
+			// Files that couldn't be looked at may still be there
+			if complete {
+				s.pruneHighWaterMarks()
+			}
+			s.foundFileIDs = nil
+
+			waiting, byGroup := s.readerPool.WaitingCounts()
+			GlobalStatistics.UpdateFileReaderPoolWaiting(waiting, byGroup)
+
+			if watcher != nil {
+				if err := watcher.SetDirectories(watchDirectories(patterns)); err != nil {
+					if !watchLimitReached {
+						logger.Report(err, grohl.Data{"msg": "failed to watch some directories", "resolution": "polling them"})
+					}
+					watchLimitReached = true
+				} else {
+					watchLimitReached = false
+				}
+			}
 			timer.Reset(s.GlobRefresh)
 		}
 	}
 }
 
+// pruneHighWaterMarks forgets the high water marks of files that the glob
+// that just finished didn't find, and that aren't being read, e.g. because
+// they were deleted. Otherwise a new file that reuses a deleted file's device
+// and inode would be read from where the deleted one left off.
+func (s *Supervisor) pruneHighWaterMarks() {
+	found := s.foundFileIDs
+	err := s.snapshotter.PruneHighWaterMarks(func(fileID FileID) bool {
+		return found[fileID] || s.readerPool.IsFileInPool(fileID)
+	})
+	if err != nil {
+		grohl.Report(err, grohl.Data{"ns": "Supervisor", "fn": "pruneHighWaterMarks", "msg": "failed to prune high water marks", "resolution": "trying again after the next glob"})
+	}
+}
+
+// setGroupGlobbed records that a file group's paths have been globbed, unless
+// Reload has replaced it since.
+func (s *Supervisor) setGroupGlobbed(config FileConfiguration) {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if containsFileConfiguration(s.files, config) {
+		s.globbedGroups[config.GroupName()] = true
+	}
+}
+
+// groupGlobbed returns true if a file group's paths have been globbed since
+// it was added or changed.
+func (s *Supervisor) groupGlobbed(config FileConfiguration) bool {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	return s.globbedGroups[config.GroupName()]
+}
+
+// startWatchedFiles starts readers for files that watch events came in for,
+// if they belong to a file group.
+func (s *Supervisor) startWatchedFiles(paths map[string]bool) {
+	logger := grohl.NewContext(grohl.Data{"ns": "Supervisor", "fn": "startWatchedFiles"})
+
+	files := s.currentFiles()
+	for filePath := range paths {
+		config, ok := matchingFileConfiguration(files, filePath)
+		if !ok {
+			continue
+		}
+
+		if err := s.startFileReader(filePath, config); err != nil && !os.IsNotExist(err) {
+			logger.Report(err, grohl.Data{"filePath": filePath, "msg": "failed to start reader", "resolution": "skipping file"})
+		}
+	}
+}
+
+// matchingFileConfiguration returns the first file group whose paths match
+// filePath, the way globbing for the group would.
+func matchingFileConfiguration(files []FileConfiguration, filePath string) (FileConfiguration, bool) {
+	for _, config := range files {
+		if matchesAnyPath(config.ExcludePaths, filePath) {
+			continue
+		}
+
+		for _, path := range config.Paths {
+			if path != stdinPath && matchPath(path, filePath) {
+				return config, true
+			}
+		}
+	}
+
+	return FileConfiguration{}, false
+}
+
 // startFileReader starts an individual file reader at a given path, if one
-// isn't already running.
-func (s *Supervisor) startFileReader(filePath string, fields map[string]string) error {
-	// There's already a reader in the pool for this path
-	if s.readerPool.IsPathInPool(filePath) {
-		return nil
+// isn't already running for the file currently at that path.
+//
+// Files are identified by FileID rather than path. When a file is rotated by
+// renaming it, its existing reader keeps draining it to EOF while the new file
+// at the same path gets a reader of its own, starting from the beginning.
+func (s *Supervisor) startFileReader(filePath string, config FileConfiguration) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
 	}
 
-	highWaterMark, err := s.snapshotter.HighWaterMark(filePath)
+	fileID, err := statFileID(file)
 	if err != nil {
+		file.Close()
 		return err
 	}
+	if s.foundFileIDs != nil {
+		s.foundFileIDs[fileID] = true
+	}
 
-	file, err := os.Open(filePath)
+	// There's already a reader in the pool for this file
+	if s.readerPool.IsFileInPool(fileID) {
+		file.Close()
+		return nil
+	}
+
+	highWaterMark, err := s.snapshotter.HighWaterMark(fileID, filePath)
 	if err != nil {
+		file.Close()
 		return err
 	}
 
@@ -305,6 +1421,22 @@ func (s *Supervisor) startFileReader(filePath string, fields map[string]string)
 		return err
 	}
 
+	// Files that were already there when butteredscones started, but haven't
+	// been read before, may be read from the end
+	if highWaterMark.Position == 0 && config.StartPosition == StartPositionEnd && !s.groupGlobbed(config) {
+		file.Close()
+		return s.skipToEnd(highWaterMark, stat.Size(), "start_position is end")
+	}
+
+	// If the file is smaller than the high water mark, it was truncated in
+	// place since it was last read. Start over from the beginning.
+	if stat.Size() < highWaterMark.Position {
+		grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "startFileReader", "status": "truncated", "file": filePath, "position": highWaterMark.Position, "size": stat.Size(), "resolution": "reading from beginning"})
+		GlobalStatistics.IncrementFileTruncations(fileID, filePath)
+
+		highWaterMark.Position = 0
+	}
+
 	// If the file's current size isn't beyond the high water mark, it'll
 	// immediately EOF so there's no use in creating a reader for it.
 	if stat.Size() <= highWaterMark.Position {
@@ -312,20 +1444,110 @@ func (s *Supervisor) startFileReader(filePath string, fields map[string]string)
 		return nil
 	}
 
+	if config.IgnoreOlder > 0 && time.Since(stat.ModTime()) > time.Duration(config.IgnoreOlder) {
+		file.Close()
+		return s.skipToEnd(highWaterMark, stat.Size(), "older than ignore_older")
+	}
+
+	if !s.hasReaderSlot(config) {
+		file.Close()
+		s.readerPool.Wait(filePath, config)
+		return nil
+	}
+
 	_, err = file.Seek(highWaterMark.Position, os.SEEK_SET)
 	if err != nil {
 		file.Close()
 		return err
 	}
-	GlobalStatistics.SetFilePosition(filePath, highWaterMark.Position)
-	GlobalStatistics.SetFileSnapshotPosition(filePath, highWaterMark.Position)
+	processors, err := NewProcessors(config.Processors)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	GlobalStatistics.SetFilePosition(fileID, filePath, highWaterMark.Position)
+	GlobalStatistics.SetFileSnapshotPosition(fileID, filePath, highWaterMark.Position)
+
+	reader, err := NewFileReaderWithOptions(file, &FileReaderOptions{
+		Fields:    config.Fields,
+		ChunkSize: supervisorReaderChunkSize,
+		MaxLength: s.MaxLength,
+		Multiline: config.Multiline,
+		Framing:   config.Framing,
+		Encoding:  config.Encoding,
+		Codec:     config.Codec,
+		Metadata:  config.Metadata,
+		Notify:    s.readerPool.Notify(),
 
-	reader, err := NewFileReader(file, fields, supervisorReaderChunkSize, s.MaxLength)
+		IncludeLines: config.IncludeLines,
+		ExcludeLines: config.ExcludeLines,
+
+		CloseInactive: time.Duration(config.CloseInactive),
+	})
 	if err != nil {
 		file.Close()
 		return err
 	}
 
-	s.readerPool.Add(reader)
+	s.configLock.Lock()
+	s.readerConfigs[reader] = config
+	s.readerProcessors[reader] = processors
+	s.setReaderGroup(reader, config)
+	s.configLock.Unlock()
+
+	s.readerPool.AddToGroup(reader, config)
+	GlobalStatistics.SetFileGroup(fileID, filePath, config.GroupName())
+	return nil
+}
+
+// skipToEnd saves the size of a file as its high water mark, so that what's
+// in it now is never read.
+func (s *Supervisor) skipToEnd(highWaterMark *HighWaterMark, size int64, reason string) error {
+	grohl.Log(grohl.Data{"ns": "Supervisor", "fn": "skipToEnd", "file": highWaterMark.FilePath, "position": highWaterMark.Position, "size": size, "reason": reason, "resolution": "skipping to end of file"})
+
+	highWaterMark.Position = size
+	return s.snapshotter.SetHighWaterMarks([]*HighWaterMark{highWaterMark})
+}
+
+// startStdinReader starts a reader for standard input, unless one has already
+// been started. Standard input is only read once; after EOF, it is not read
+// again.
+func (s *Supervisor) startStdinReader(config FileConfiguration) error {
+	if s.stdinStarted {
+		return nil
+	}
+
+	processors, err := NewProcessors(config.Processors)
+	if err != nil {
+		return err
+	}
+
+	reader, err := NewFileReaderWithOptions(s.stdin, &FileReaderOptions{
+		Fields:    config.Fields,
+		ChunkSize: supervisorReaderChunkSize,
+		MaxLength: s.MaxLength,
+		Multiline: config.Multiline,
+		Framing:   config.Framing,
+		Encoding:  config.Encoding,
+		Codec:     config.Codec,
+		Metadata:  config.Metadata,
+		Notify:    s.readerPool.Notify(),
+
+		IncludeLines: config.IncludeLines,
+		ExcludeLines: config.ExcludeLines,
+		Stream:       true,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.configLock.Lock()
+	s.readerProcessors[reader] = processors
+	s.setReaderGroup(reader, config)
+	s.configLock.Unlock()
+
+	s.stdinStarted = true
+	s.readerPool.AddToGroup(reader, config)
 	return nil
 }
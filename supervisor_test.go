@@ -1,8 +1,13 @@
 package butteredscones
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -33,16 +38,305 @@ func TestSupervisorSmokeTest(t *testing.T) {
 	defer supervisor.Stop()
 
 	<-time.After(250 * time.Millisecond)
-	if testClient.DataSent == nil {
+	if len(testClient.Sent()) == 0 {
 		t.Fatalf("no data sent on test client before timeout")
 	}
 
-	data := testClient.DataSent[0]
+	data := testClient.Sent()[0]
 	if data["line"] != "line1" {
 		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", data["line"])
 	}
 
-	hwm, err := snapshotter.HighWaterMark(tmpFile.Name())
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 6 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 6, hwm.Position)
+	}
+}
+
+func TestSupervisorRotatedFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "app.log")
+	if err = ioutil.WriteFile(logPath, []byte("line1\nline2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{logPath}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 50 * time.Millisecond
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+
+	// Rotate the file, and create a new one that is smaller than the position
+	// already read into the old one.
+	if err = os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(logPath, []byte("new1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 3 {
+		t.Fatalf("expected 3 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	data := testClient.Sent()[2]
+	if data["line"] != "new1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "new1", data["line"])
+	}
+}
+
+func TestSupervisorTruncatedFile(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("new1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file was previously read further than it is long now
+	snapshotter := &MemorySnapshotter{}
+	snapshotter.SetHighWaterMarks([]*HighWaterMark{
+		&HighWaterMark{FileID: fileID, FilePath: tmpFile.Name(), Position: 1024},
+	})
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient := &client.TestClient{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) == 0 {
+		t.Fatalf("no data sent on test client before timeout")
+	}
+
+	data := testClient.Sent()[0]
+	if data["line"] != "new1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "new1", data["line"])
+	}
+
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 5 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 5, hwm.Position)
+	}
+}
+
+func TestSupervisorStdin(t *testing.T) {
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinReader.Close()
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{"-"}, Fields: map[string]string{"type": "stdin"}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.stdin = stdinReader
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	if _, err = stdinWriter.Write([]byte("line1\nline2")); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent before EOF, but got %d", len(testClient.Sent()))
+	}
+
+	stdinWriter.Close()
+	select {
+	case <-supervisor.StdinDone():
+		// success
+	case <-time.After(500 * time.Millisecond):
+		t.Fatalf("timeout waiting for standard input to be done")
+	}
+
+	if len(testClient.Sent()) != 2 {
+		t.Fatalf("expected 2 lines to be sent after EOF, but got %d", len(testClient.Sent()))
+	}
+	if data := testClient.Sent()[1]; data["line"] != "line2" || data["type"] != "stdin" {
+		t.Fatalf("expected line2 from stdin, but got %#v", data)
+	}
+}
+
+func TestSupervisorStdinDiskQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinReader.Close()
+
+	queue, err := NewDiskQueue(filepath.Join(tmpDir, "queue"), 0, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{"-"}},
+	}
+	// The server is down, so the lines can only be queued
+	testClient := &client.TestClient{Error: errors.New("connection refused")}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.stdin = stdinReader
+	supervisor.DiskQueue = queue
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	if _, err = stdinWriter.Write([]byte("line1\n")); err != nil {
+		t.Fatal(err)
+	}
+	stdinWriter.Close()
+
+	select {
+	case <-supervisor.StdinDone():
+		t.Fatalf("expected standard input not to be done while its lines are still queued")
+	case <-time.After(500 * time.Millisecond):
+		// still queued
+	}
+
+	testClient.SetError(nil)
+	select {
+	case <-supervisor.StdinDone():
+		// success
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for standard input to be done")
+	}
+
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+}
+
+func TestSupervisorPartialAcknowledgement(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\nline3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient := &client.TestClient{AckLimit: 2}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 3 {
+		t.Fatalf("expected 3 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+	if data := testClient.Sent()[2]; data["line"] != "line3" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line3", data["line"])
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 18 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 18, hwm.Position)
+	}
+}
+
+func TestSupervisorBroadcast(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient1 := &client.TestClient{}
+	testClient2 := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient1, testClient2}, snapshotter, 0)
+	supervisor.NetworkMode = NetworkModeBroadcast
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	for _, testClient := range []*client.TestClient{testClient1, testClient2} {
+		if len(testClient.Sent()) != 1 {
+			t.Fatalf("expected 1 line to be sent to each client, but got %d", len(testClient.Sent()))
+		}
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -50,3 +344,1089 @@ func TestSupervisorSmokeTest(t *testing.T) {
 		t.Fatalf("expected high water mark position to be %d, but got %d", 6, hwm.Position)
 	}
 }
+
+func TestSupervisorBroadcastWaitsForAllClients(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient1 := &client.TestClient{}
+	testClient2 := &client.TestClient{Error: errors.New("connection refused")}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient1, testClient2}, snapshotter, 0)
+	supervisor.NetworkMode = NetworkModeBroadcast
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient1.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent to the healthy client, but got %d", len(testClient1.Sent()))
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 0 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 0, hwm.Position)
+	}
+}
+
+func TestSupervisorFailover(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	primary := &client.TestClient{Error: errors.New("connection refused")}
+	standby1 := &client.TestClient{}
+	standby2 := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{primary, standby1, standby2}, snapshotter, 0)
+	supervisor.NetworkMode = NetworkModeFailover
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(standby1.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent to the first standby, but got %d", len(standby1.Sent()))
+	}
+	if len(standby2.Sent()) != 0 {
+		t.Fatalf("expected no lines to be sent to the second standby, but got %d", len(standby2.Sent()))
+	}
+}
+
+func TestSupervisorDiskQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "app.log")
+	if err = ioutil.WriteFile(logPath, []byte("line1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewDiskQueue(filepath.Join(tmpDir, "queue"), 0, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{logPath}},
+	}
+	// The server is down, so nothing can be sent
+	testClient := &client.TestClient{Error: errors.New("connection refused")}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.DiskQueue = queue
+	supervisor.Start()
+
+	<-time.After(250 * time.Millisecond)
+	supervisor.Stop()
+
+	// Progress is saved once the line is queued, even though it wasn't sent
+	file, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	fileID, err := statFileID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 6 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 6, hwm.Position)
+	}
+
+	// The line is still queued, and is sent once the server is back
+	queue, err = NewDiskQueue(filepath.Join(tmpDir, "queue"), 0, DiskQueueOverflowBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClient = &client.TestClient{}
+
+	supervisor = NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.DiskQueue = queue
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+	if data := testClient.Sent()[0]; data["line"] != "line1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", data["line"])
+	}
+}
+
+func TestSupervisorReloadFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	firstPath := filepath.Join(tmpDir, "first.log")
+	secondPath := filepath.Join(tmpDir, "second.log")
+	for _, path := range []string{firstPath, secondPath} {
+		if err = ioutil.WriteFile(path, []byte("line1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{firstPath}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = time.Hour
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	// The new path is picked up right away, without waiting for GlobRefresh
+	files = append(files, FileConfiguration{Paths: []string{secondPath}, Fields: map[string]string{"type": "second"}})
+	supervisor.Reload(files, []client.Client{testClient})
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 2 {
+		t.Fatalf("expected 2 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+	if data := testClient.Sent()[1]; data["type"] != "second" {
+		t.Fatalf("expected [\"type\"] to be %q, but got %q", "second", data["type"])
+	}
+}
+
+func TestSupervisorReloadRotatedFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rotatedFile, err := os.Create(filepath.Join(tmpDir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotatedFile.Close()
+	if _, err = rotatedFile.Write([]byte("line1\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{rotatedFile.Name()}, CloseInactive: Duration(time.Hour)},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = time.Hour
+	supervisor.WatchFiles = false
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	// Once rotated, the file won't be found again, so its reader isn't
+	// stopped when its group changes
+	if err = os.Rename(rotatedFile.Name(), rotatedFile.Name()+".1"); err != nil {
+		t.Fatal(err)
+	}
+	files = []FileConfiguration{
+		FileConfiguration{Paths: []string{rotatedFile.Name()}, CloseInactive: Duration(time.Hour), Fields: map[string]string{"type": "app"}},
+	}
+	supervisor.Reload(files, []client.Client{testClient})
+
+	<-time.After(250 * time.Millisecond)
+	if _, err = rotatedFile.Write([]byte("line2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(500 * time.Millisecond)
+	if len(testClient.Sent()) != 2 || testClient.Sent()[1]["line"] != "line2" {
+		t.Fatalf("expected line2 to be sent, but got %v", testClient.Sent())
+	}
+}
+
+func TestSupervisorReloadClients(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logPath := filepath.Join(tmpDir, "app.log")
+	if err = ioutil.WriteFile(logPath, []byte("line1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{logPath}},
+	}
+	oldClient := &client.TestClient{}
+	newClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{oldClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 50 * time.Millisecond
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(oldClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent to the old client, but got %d", len(oldClient.Sent()))
+	}
+
+	supervisor.Reload(files, []client.Client{newClient})
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Write([]byte("line2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// populateReadyChunks has been backing off since the first line
+	<-time.After(time.Second)
+	if len(oldClient.Sent()) != 1 {
+		t.Fatalf("expected no more lines to be sent to the old client, but got %d", len(oldClient.Sent()))
+	}
+	if len(newClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent to the new client, but got %d", len(newClient.Sent()))
+	}
+	if data := newClient.Sent()[0]; data["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", data["line"])
+	}
+}
+
+func TestSupervisorFilteredLines(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nnoise\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}, ExcludeLines: []string{"^noise"}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+	if testClient.Sent()[0]["line"] != "line1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", testClient.Sent()[0]["line"])
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Progress moves past the filtered line at the end of the file
+	if hwm.Position != 12 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 12, hwm.Position)
+	}
+}
+
+func TestSupervisorWatchFiles(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("file watching is only supported on Linux")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{filepath.Join(tmpDir, "**/*.log")}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	// Only file watching can find the file in time
+	supervisor.GlobRefresh = time.Hour
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(100 * time.Millisecond)
+	if err := os.Mkdir(filepath.Join(tmpDir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Give the new directory a chance to be watched
+	<-time.After(100 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "nested", "app.log"), []byte("line1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+	if testClient.Sent()[0]["line"] != "line1" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line1", testClient.Sent()[0]["line"])
+	}
+}
+
+func TestSupervisorIgnoreOlder(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(tmpFile.Name(), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}, IgnoreOlder: Duration(time.Hour)},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 0 {
+		t.Fatalf("expected no lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, tmpFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hwm.Position != 6 {
+		t.Fatalf("expected high water mark position to be %d, but got %d", 6, hwm.Position)
+	}
+}
+
+func TestSupervisorStartPositionEnd(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}, StartPosition: StartPositionEnd},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 100 * time.Millisecond
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 0 {
+		t.Fatalf("expected no lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	// Lines written after starting are read
+	_, err = tmpFile.Write([]byte("line2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+	if testClient.Sent()[0]["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", testClient.Sent()[0]["line"])
+	}
+}
+
+func TestSupervisorReloadStartPositionEnd(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor([]FileConfiguration{}, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 100 * time.Millisecond
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	// The file was already there when its group was added
+	<-time.After(250 * time.Millisecond)
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}, StartPosition: StartPositionEnd},
+	}
+	supervisor.Reload(files, []client.Client{testClient})
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 0 {
+		t.Fatalf("expected no lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	_, err = tmpFile.Write([]byte("line2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+	if testClient.Sent()[0]["line"] != "line2" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "line2", testClient.Sent()[0]["line"])
+	}
+}
+
+func TestSupervisorPrunesHighWaterMarks(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileID, err := statFileID(tmpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that has since been deleted
+	deletedID := FileID{Device: fileID.Device, Inode: fileID.Inode + 1}
+	snapshotter := &MemorySnapshotter{}
+	snapshotter.SetHighWaterMarks([]*HighWaterMark{
+		&HighWaterMark{FileID: deletedID, FilePath: tmpFile.Name() + ".1", Position: 100},
+	})
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient := &client.TestClient{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 50 * time.Millisecond
+	supervisor.WatchFiles = false
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if mark, _ := snapshotter.HighWaterMark(deletedID, tmpFile.Name()); mark.Position != 0 {
+		t.Fatalf("expected deleted file's high water mark to be pruned, but got %d", mark.Position)
+	}
+	if mark, _ := snapshotter.HighWaterMark(fileID, tmpFile.Name()); mark.Position != 6 {
+		t.Fatalf("expected high water mark to be %d, but got %d", 6, mark.Position)
+	}
+}
+
+func TestSupervisorMaxOpenFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{filepath.Join(tmpDir, "*.log")}, MaxOpenFiles: 1},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = time.Hour
+	supervisor.WatchFiles = false
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	// Each file waits its turn, and is read once the one before it is done
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 3 {
+		t.Fatalf("expected 3 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+}
+
+func TestSupervisorMaxOpenFilesRotatedFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rotatedFile, err := os.Create(filepath.Join(tmpDir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotatedFile.Close()
+	if _, err = rotatedFile.Write([]byte("a1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "b.log"), []byte("b1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{filepath.Join(tmpDir, "*.log")}, CloseInactive: Duration(time.Hour)},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.MaxOpenFiles = 1
+	supervisor.GlobRefresh = 50 * time.Millisecond
+	supervisor.WatchFiles = false
+	supervisor.readerTurn = 100 * time.Millisecond
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 || testClient.Sent()[0]["line"] != "a1" {
+		t.Fatalf("expected a1 to be sent, but got %v", testClient.Sent())
+	}
+
+	// Once rotated, the file isn't found by the glob again, so its reader
+	// finishes it even though its turn is over
+	if err = os.Rename(rotatedFile.Name(), filepath.Join(tmpDir, "a.log.1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rotatedFile.Write([]byte("a2\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(500 * time.Millisecond)
+	if len(testClient.Sent()) != 2 || testClient.Sent()[1]["line"] != "a2" {
+		t.Fatalf("expected a2 to be sent, but got %v", testClient.Sent())
+	}
+}
+
+func TestSupervisorReaderSlotWanted(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+	otherFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherFile.Close()
+	defer os.Remove(otherFile.Name())
+
+	app := FileConfiguration{Name: "app"}
+	audit := FileConfiguration{Name: "audit", MaxOpenFiles: 1}
+
+	supervisor := NewSupervisor(nil, []client.Client{&client.TestClient{}}, &MemorySnapshotter{}, 0)
+	supervisor.MaxOpenFiles = 2
+	supervisor.readerPool = NewFileReaderPool()
+	appReader, _ := NewFileReader(tmpFile, map[string]string{}, 128, 0)
+	supervisor.readerPool.AddToGroup(appReader, app)
+	auditReader, _ := NewFileReader(otherFile, map[string]string{}, 128, 0)
+	supervisor.readerPool.AddToGroup(auditReader, audit)
+
+	// A file waiting because its own group is full can't have an app reader's
+	// place
+	supervisor.readerPool.Wait("/var/log/audit2.log", audit)
+	if supervisor.readerSlotWanted("app") {
+		t.Fatalf("expected app reader's place not to be wanted")
+	}
+	if !supervisor.readerSlotWanted("audit") {
+		t.Fatalf("expected audit reader's place to be wanted")
+	}
+
+	// A file only waiting because of the global limit can
+	supervisor.readerPool.Wait("/var/log/debug.log", FileConfiguration{Name: "debug"})
+	if !supervisor.readerSlotWanted("app") {
+		t.Fatalf("expected app reader's place to be wanted")
+	}
+}
+
+func TestSupervisorGroupRateLimit(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	noisyFile, err := os.Create(filepath.Join(tmpDir, "noisy.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noisyFile.Close()
+	quietFile, err := os.Create(filepath.Join(tmpDir, "quiet.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer quietFile.Close()
+
+	if _, err = noisyFile.Write([]byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Name: "noisy", Paths: []string{noisyFile.Name()}, RateLimit: RateLimitConfiguration{EventsPerSecond: 5}},
+		FileConfiguration{Name: "quiet", Paths: []string{quietFile.Name()}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.GlobRefresh = 50 * time.Millisecond
+	supervisor.WatchFiles = false
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	// The first chunk goes through, but puts the group a second behind
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 10 {
+		t.Fatalf("expected 10 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	if _, err = noisyFile.Write([]byte("11\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = quietFile.Write([]byte("quiet\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other groups aren't held up while the noisy one waits
+	<-time.After(300 * time.Millisecond)
+	if len(testClient.Sent()) != 11 {
+		t.Fatalf("expected 11 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+	if testClient.Sent()[10]["line"] != "quiet" {
+		t.Fatalf("expected [\"line\"] to be %q, but got %q", "quiet", testClient.Sent()[10]["line"])
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 12 {
+		t.Fatalf("expected 12 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+	if throttled := GlobalStatistics.GroupStatistics()["noisy"].ThrottledSeconds; throttled < 0.9 || throttled > 1.5 {
+		t.Fatalf("expected noisy group to be throttled for about 1 second, but got %f", throttled)
+	}
+}
+
+func TestSupervisorClientRateLimit(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte("line1\nline2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.SetClientRateLimit(testClient, RateLimitConfiguration{BytesPerSecond: 5})
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	// 10 bytes puts the client a second behind, so the next line waits
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 2 {
+		t.Fatalf("expected 2 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	_, err = tmpFile.Write([]byte("line3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 2 {
+		t.Fatalf("expected 2 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 3 {
+		t.Fatalf("expected 3 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+}
+
+func TestSupervisorRateLimitJSONCodec(t *testing.T) {
+	tmpFile, err := ioutil.TempFile("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write([]byte(`{"msg":"one"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{tmpFile.Name()}, Codec: &CodecConfiguration{Type: CodecJSON}},
+	}
+	testClient := &client.TestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.SetClientRateLimit(testClient, RateLimitConfiguration{BytesPerSecond: 6.5})
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	// Events decoded from JSON have no "line" field, but the 13 bytes they were
+	// read from still put the client a second behind
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	_, err = tmpFile.Write([]byte(`{"msg":"two"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-time.After(250 * time.Millisecond)
+	if len(testClient.Sent()) != 1 {
+		t.Fatalf("expected 1 line to be sent, but got %d", len(testClient.Sent()))
+	}
+
+	<-time.After(1 * time.Second)
+	if len(testClient.Sent()) != 2 {
+		t.Fatalf("expected 2 lines to be sent, but got %d", len(testClient.Sent()))
+	}
+}
+
+// pipelinedTestClient is a client.PipelinedClient that keeps each window it's
+// sent in flight until the test finishes it.
+type pipelinedTestClient struct {
+	lock    sync.Mutex
+	windows []*client.Window
+	lines   [][]client.Data
+	sends   int
+
+	// Returned by SendWindow, if set
+	err error
+}
+
+func (c *pipelinedTestClient) Name() string {
+	return fmt.Sprintf("pipelinedTestClient[%p]", c)
+}
+
+func (c *pipelinedTestClient) Send(lines []client.Data) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sends += 1
+	return len(lines), nil
+}
+
+func (c *pipelinedTestClient) SendWindow(lines []client.Data) (*client.Window, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	window := client.NewWindow()
+	c.windows = append(c.windows, window)
+	c.lines = append(c.lines, lines)
+	return window, nil
+}
+
+// SetError makes SendWindow fail with err, or succeed again if it's nil.
+func (c *pipelinedTestClient) SetError(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.err = err
+}
+
+// Windows returns the windows sent so far and the lines in each, and the
+// number of times Send was called instead.
+func (c *pipelinedTestClient) Windows() ([]*client.Window, [][]client.Data, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return append([]*client.Window(nil), c.windows...), append([][]client.Data(nil), c.lines...), c.sends
+}
+
+func TestSupervisorPipelinedClient(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{"a.log", "b.log"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, mode := range []string{NetworkModeLoadBalance, NetworkModeFailover, NetworkModeBroadcast} {
+		files := []FileConfiguration{
+			FileConfiguration{Paths: []string{filepath.Join(tmpDir, "*.log")}},
+		}
+		testClient := &pipelinedTestClient{}
+		snapshotter := &MemorySnapshotter{}
+
+		supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+		supervisor.NetworkMode = mode
+		// Each file's line is sent in a window of its own
+		supervisor.SpoolSize = 1
+		supervisor.Start()
+
+		// The second window is sent before the first is acknowledged
+		<-time.After(250 * time.Millisecond)
+		windows, _, sends := testClient.Windows()
+		if len(windows) != 2 || sends != 0 {
+			supervisor.Stop()
+			t.Fatalf("%s: expected 2 windows in flight and no calls to Send, but got %d and %d", mode, len(windows), sends)
+		}
+
+		for _, window := range windows {
+			window.Finish(1, nil)
+		}
+		<-time.After(100 * time.Millisecond)
+		supervisor.Stop()
+
+		for _, name := range []string{"a.log", "b.log"} {
+			hwm := fileHighWaterMark(t, snapshotter, filepath.Join(tmpDir, name))
+			if hwm.Position != 6 {
+				t.Fatalf("%s: expected high water mark position of %s to be %d, but got %d", mode, name, 6, hwm.Position)
+			}
+		}
+	}
+}
+
+func TestSupervisorPipelinedAcknowledgementOrder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	names := []string{"a.log", "b.log", "c.log"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{filepath.Join(tmpDir, "*.log")}},
+	}
+	testClient := &pipelinedTestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.SpoolSize = 1
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	windows, lines, _ := testClient.Windows()
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows in flight, but got %d", len(windows))
+	}
+
+	// Windows acknowledged out of order wait for the ones sent before them
+	windows[2].Finish(1, nil)
+	windows[1].Finish(1, nil)
+	<-time.After(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		name := lines[i][0]["line"].(string)
+		if hwm := fileHighWaterMark(t, snapshotter, filepath.Join(tmpDir, name)); hwm.Position != 0 {
+			t.Fatalf("expected high water mark position of %s to be %d before the first window is acknowledged, but got %d", name, 0, hwm.Position)
+		}
+	}
+
+	windows[0].Finish(1, nil)
+	<-time.After(100 * time.Millisecond)
+	for _, name := range names {
+		if hwm := fileHighWaterMark(t, snapshotter, filepath.Join(tmpDir, name)); hwm.Position != 6 {
+			t.Fatalf("expected high water mark position of %s to be %d, but got %d", name, 6, hwm.Position)
+		}
+	}
+}
+
+func TestSupervisorBroadcastRetriesPipelinedWindows(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "butteredscones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	names := []string{"a.log", "b.log", "c.log"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []FileConfiguration{
+		FileConfiguration{Paths: []string{filepath.Join(tmpDir, "*.log")}},
+	}
+	testClient := &pipelinedTestClient{}
+	snapshotter := &MemorySnapshotter{}
+
+	supervisor := NewSupervisor(files, []client.Client{testClient}, snapshotter, 0)
+	supervisor.NetworkMode = NetworkModeBroadcast
+	supervisor.SpoolSize = 1
+	supervisor.Start()
+	defer supervisor.Stop()
+
+	<-time.After(250 * time.Millisecond)
+	windows, _, _ := testClient.Windows()
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows in flight, but got %d", len(windows))
+	}
+
+	// Every window fails, and so does sending them again for a while, so both
+	// the sending and the acknowledging goroutines put chunks back to retry
+	testClient.SetError(errors.New("connection refused"))
+	for _, window := range windows {
+		window.Finish(0, errors.New("connection reset"))
+	}
+	<-time.After(300 * time.Millisecond)
+	testClient.SetError(nil)
+
+	<-time.After(1 * time.Second)
+	windows, _, _ = testClient.Windows()
+	if len(windows) != 6 {
+		t.Fatalf("expected 3 windows to be sent again, but got %d", len(windows)-3)
+	}
+	for _, window := range windows[3:] {
+		window.Finish(1, nil)
+	}
+
+	<-time.After(100 * time.Millisecond)
+	for _, name := range names {
+		if hwm := fileHighWaterMark(t, snapshotter, filepath.Join(tmpDir, name)); hwm.Position != 6 {
+			t.Fatalf("expected high water mark position of %s to be %d, but got %d", name, 6, hwm.Position)
+		}
+	}
+}
+
+// fileHighWaterMark returns the high water mark saved for the file at a path.
+func fileHighWaterMark(t *testing.T, snapshotter Snapshotter, filePath string) *HighWaterMark {
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	fileID, err := statFileID(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hwm, err := snapshotter.HighWaterMark(fileID, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hwm
+}